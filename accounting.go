@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// accountedAppFields are the nvidia-smi --query-accounted-apps fields read
+// every cycle. They are NVML's per-process accounting stats, which cover the
+// whole lifetime of a process and outlive it.
+var accountedAppFields = []string{"gpu_uuid", "pid", "gpu_utilization", "max_memory_usage"}
+
+// enableGPUAccounting turns on accounting mode on all GPUs. It requires root
+// and persists until the driver is reloaded, so it can also be enabled
+// beforehand by the node's provisioning.
+func enableGPUAccounting(ctx context.Context) error {
+	if output, err := nvidiaSMI(ctx, "-am", "1").CombinedOutput(); err != nil {
+		return fmt.Errorf("nvidia-smi -am 1 failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+type accountingKey struct {
+	gpuID string
+	jobID string
+}
+
+// gpuAccounting attributes NVML accounting stats to jobs. Accounting records
+// are kept after a process exits, but its cgroup membership isn't, so the job
+// of every PID seen in a job's cgroup is remembered for as long as the PID
+// has a record. Processes that start and exit between two cycles are never
+// seen and can't be attributed.
+type gpuAccounting struct {
+	avgUtilization *prometheus.GaugeVec
+	maxMemory      *prometheus.GaugeVec
+
+	pidJobs map[string]string
+	series  map[accountingKey]struct{}
+	gpu     GPUConfig
+}
+
+// newGPUAccounting creates the accounting collector and registers its metrics
+// with reg. GPUs excluded in gpu are skipped.
+func newGPUAccounting(reg prometheus.Registerer, gpu GPUConfig) *gpuAccounting {
+	a := &gpuAccounting{
+		avgUtilization: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "job_gpu_avg_utilization_percent",
+			Help: "Mean over the job's processes of their lifetime average GPU utilization, from NVML accounting.",
+		}, []string{"gpu_id", "job_id"}),
+
+		maxMemory: prometheus.NewGaugeVec(memoryGaugeOpts(prometheus.GaugeOpts{
+			Name: "job_gpu_max_memory_bytes",
+			Help: "Highest GPU memory usage in bytes of any of the job's processes over its lifetime, from NVML accounting.",
+		}), []string{"gpu_id", "job_id"}),
+
+		pidJobs: make(map[string]string),
+		series:  make(map[accountingKey]struct{}),
+		gpu:     gpu,
+	}
+	register(reg, a.avgUtilization, a.maxMemory)
+	return a
+}
+
+// collect exposes the accounting stats of the running jobs, and removes the
+// series of jobs that ended.
+func (a *gpuAccounting) collect(ctx context.Context, jobs []slurmJob) error {
+	uuids, err := queryGPUUUIDs(ctx)
+	if err != nil {
+		return err
+	}
+	uuidToIndex := make(map[string]string, len(uuids))
+	for index, uuid := range uuids {
+		uuidToIndex[uuid] = index
+	}
+
+	output, err := nvidiaSMI(ctx, "--query-accounted-apps="+strings.Join(accountedAppFields, ","), "--format=csv,noheader,nounits").Output()
+	if err != nil {
+		return fmt.Errorf("failed to query accounted apps: %v", err)
+	}
+
+	jobIDs := make(map[string]struct{}, len(jobs))
+	current := make(map[string]struct{})
+	for _, job := range jobs {
+		jobIDs[job.ID] = struct{}{}
+		for _, pid := range job.PIDs {
+			a.pidJobs[pid] = job.ID
+			current[pid] = struct{}{}
+		}
+	}
+
+	type jobStats struct {
+		utilizationSum float64
+		processes      int
+		maxMemory      float64
+	}
+	stats := make(map[accountingKey]*jobStats)
+	recorded := make(map[string]struct{})
+
+	for _, app := range parseGPUQuery(output, accountedAppFields) {
+		pid := app["pid"]
+		recorded[pid] = struct{}{}
+
+		jobID, ok := a.pidJobs[pid]
+		if !ok {
+			continue
+		}
+		if _, running := jobIDs[jobID]; !running {
+			continue
+		}
+		index, ok := uuidToIndex[app["gpu_uuid"]]
+		if !ok || a.gpu.excludes(index, app["gpu_uuid"]) {
+			continue
+		}
+
+		key := accountingKey{gpuID: index, jobID: jobID}
+		s := stats[key]
+		if s == nil {
+			s = &jobStats{}
+			stats[key] = s
+		}
+		// Processes that are still starting up report [N/A].
+		if utilization, err := parsePercent(app["gpu_utilization"]); err == nil {
+			s.utilizationSum += utilization
+			s.processes++
+		}
+		if memory, err := parseMiB(app["max_memory_usage"]); err == nil && memory > s.maxMemory {
+			s.maxMemory = memory
+		}
+	}
+
+	// Forget the PIDs of jobs that ended, and exited PIDs without a record.
+	for pid, jobID := range a.pidJobs {
+		_, running := jobIDs[jobID]
+		_, hasRecord := recorded[pid]
+		_, inCgroup := current[pid]
+		if !running || (!hasRecord && !inCgroup) {
+			delete(a.pidJobs, pid)
+		}
+	}
+
+	for key := range a.series {
+		if _, exists := stats[key]; !exists {
+			labels := prometheus.Labels{"gpu_id": key.gpuID, "job_id": key.jobID}
+			a.avgUtilization.Delete(labels)
+			a.maxMemory.Delete(labels)
+			delete(a.series, key)
+		}
+	}
+	for key, s := range stats {
+		labels := prometheus.Labels{"gpu_id": key.gpuID, "job_id": key.jobID}
+		if s.processes > 0 {
+			a.avgUtilization.With(labels).Set(s.utilizationSum / float64(s.processes))
+		}
+		a.maxMemory.With(labels).Set(s.maxMemory)
+		a.series[key] = struct{}{}
+	}
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+// peerScrapeTimeout bounds each scrape of a peer, so that one unresponsive
+// node doesn't stall the aggregated response.
+const peerScrapeTimeout = 10 * time.Second
+
+// aggregatorPeer is a peer exporter and the node label of its series.
+type aggregatorPeer struct {
+	url  string
+	node string
+}
+
+// aggregator is a thin federation proxy for small clusters: every gather
+// scrapes all peer exporters concurrently and merges their metrics, adding a
+// node label to each series. Peers that fail to respond are left out and
+// reported in job_exporter_peer_up.
+type aggregator struct {
+	client   *http.Client
+	peers    []aggregatorPeer
+	registry *prometheus.Registry
+	peerUp   *prometheus.GaugeVec
+}
+
+// newAggregator returns an aggregator over the peer URLs, which validate()
+// has checked to be absolute. The node label of a peer is its host name.
+func newAggregator(peerURLs []string) *aggregator {
+	a := &aggregator{
+		client:   &http.Client{Timeout: peerScrapeTimeout},
+		registry: prometheus.NewRegistry(),
+		peerUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "job_exporter_peer_up",
+			Help: "Whether the last scrape of the peer exporter succeeded.",
+		}, []string{"node"}),
+	}
+	register(a.registry, a.peerUp)
+
+	for _, peerURL := range peerURLs {
+		u, _ := url.Parse(peerURL)
+		a.peers = append(a.peers, aggregatorPeer{url: peerURL, node: u.Hostname()})
+	}
+	return a
+}
+
+// Gather implements prometheus.Gatherer.
+func (a *aggregator) Gather() ([]*dto.MetricFamily, error) {
+	results := make([][]*dto.MetricFamily, len(a.peers))
+	var wg sync.WaitGroup
+	for i, peer := range a.peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			families, err := a.scrape(peer)
+			if err != nil {
+				fmt.Printf("WARN: Failed to scrape peer %s: %v\n", peer.url, err)
+				a.peerUp.WithLabelValues(peer.node).Set(0)
+				return
+			}
+			a.peerUp.WithLabelValues(peer.node).Set(1)
+			results[i] = families
+		}()
+	}
+	wg.Wait()
+
+	// Gatherers merges families of the same name and rejects inconsistent
+	// ones, e.g. from peers running different versions.
+	gatherers := prometheus.Gatherers{a.registry}
+	for _, families := range results {
+		if families != nil {
+			gatherers = append(gatherers, prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+				return families, nil
+			}))
+		}
+	}
+	return gatherers.Gather()
+}
+
+// scrape fetches the metrics of peer in the text format and labels every
+// series with the peer's node.
+func (a *aggregator) scrape(peer aggregatorPeer) ([]*dto.MetricFamily, error) {
+	req, err := http.NewRequest(http.MethodGet, peer.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", string(expfmt.NewFormat(expfmt.TypeTextPlain)))
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var parser expfmt.TextParser
+	byName, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse metrics: %v", err)
+	}
+
+	families := make([]*dto.MetricFamily, 0, len(byName))
+	for _, family := range byName {
+		for _, metric := range family.Metric {
+			labels := []*dto.LabelPair{{Name: proto.String("node"), Value: proto.String(peer.node)}}
+			for _, label := range metric.Label {
+				if label.GetName() != "node" {
+					labels = append(labels, label)
+				}
+			}
+			metric.Label = labels
+			sort.Slice(metric.Label, func(i, j int) bool {
+				return metric.Label[i].GetName() < metric.Label[j].GetName()
+			})
+		}
+		families = append(families, family)
+	}
+	return families, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// nvidiaProcPath holds an information file per GPU, mapping its device
+	// minor number to its UUID.
+	nvidiaProcPath = "/proc/driver/nvidia/gpus"
+
+	// nvidiaMajor is the major number of the /dev/nvidia<minor> devices.
+	// Minor 255 is /dev/nvidiactl, which every job is given.
+	nvidiaMajor    = "195"
+	nvidiactlMinor = "255"
+)
+
+// jobDevicesDir returns the directory of job in the cgroup v1 devices
+// hierarchy, which holds its device allowlist when Slurm constrains devices
+// (ConstrainDevices=yes). It is the job's directory relative to the root of
+// -cgroup.slurm-paths it was found under, placed under the same path in the
+// devices hierarchy: uid_1000/job_42 under /sys/fs/cgroup/cpu/slurm becomes
+// /sys/fs/cgroup/devices/slurm/uid_1000/job_42. ok is false if job is under
+// none of the roots.
+func jobDevicesDir(cfg *Config, job slurmJob) (string, bool) {
+	for _, root := range cfg.Cgroup.SlurmPaths {
+		rel, err := filepath.Rel(hostPath(root), job.Dir)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		// v1 hierarchies are mounted under the names of their controllers,
+		// e.g. /sys/fs/cgroup/cpu,cpuacct.
+		mountPath, ok := strings.CutPrefix(filepath.Clean(root), "/sys/fs/cgroup/")
+		if !ok {
+			continue
+		}
+		_, hierarchyPath, _ := strings.Cut(mountPath, "/")
+		return hostPath(filepath.Join("/sys/fs/cgroup/devices", hierarchyPath, rel)), true
+	}
+	return "", false
+}
+
+// jobGPUMinors returns the minor numbers of the GPUs job is allowed to
+// access, from its devices.list. The error wraps fs.ErrNotExist if there is
+// none, e.g. because devices aren't constrained or on cgroup v2, whose
+// devices controller has no allowlist to read. It returns nil if devices.list
+// allows every device. In both cases the job can access every GPU and its
+// allocation is unknown.
+func jobGPUMinors(cfg *Config, job slurmJob) ([]string, error) {
+	dir, ok := jobDevicesDir(cfg, job)
+	if !ok {
+		return nil, fmt.Errorf("%s is under no root of -cgroup.slurm-paths: %w", job.Dir, fs.ErrNotExist)
+	}
+	file, err := os.Open(filepath.Join(dir, "devices.list"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var minors []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Entries look like "c 195:0 rwm"; "a *:* rwm" allows everything.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if fields[0] == "a" {
+			return nil, nil
+		}
+		major, minor, ok := strings.Cut(fields[1], ":")
+		if fields[0] == "c" && ok && major == nvidiaMajor && minor != "*" && minor != nvidiactlMinor {
+			minors = append(minors, minor)
+		}
+	}
+	return minors, scanner.Err()
+}
+
+// gpuMinorUUIDs maps the device minor number of every GPU to its UUID. It
+// returns an empty map if the NVIDIA driver doesn't expose its proc files.
+func gpuMinorUUIDs() (map[string]string, error) {
+	dirs, err := os.ReadDir(hostPath(nvidiaProcPath))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	uuids := make(map[string]string)
+	for _, dir := range dirs {
+		content, err := os.ReadFile(filepath.Join(hostPath(nvidiaProcPath), dir.Name(), "information"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read GPU information of %s: %v", dir.Name(), err)
+		}
+
+		var uuid, minor string
+		for _, line := range strings.Split(string(content), "\n") {
+			key, value, _ := strings.Cut(line, ":")
+			switch strings.TrimSpace(key) {
+			case "GPU UUID":
+				uuid = strings.TrimSpace(value)
+			case "Device Minor":
+				minor = strings.TrimSpace(value)
+			}
+		}
+		if uuid != "" && minor != "" {
+			uuids[minor] = uuid
+		}
+	}
+	return uuids, nil
+}
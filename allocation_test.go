@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestJobGPUMinors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		args    []string
+		jobDir  string
+		devices string
+	}{
+		{
+			name:    "default root",
+			jobDir:  testJobDir,
+			devices: "/sys/fs/cgroup/devices/slurm/uid_1000/job_42/devices.list",
+		},
+		{
+			name:    "configured root",
+			args:    []string{"-cgroup.slurm-paths=/sys/fs/cgroup/cpuacct/cluster/slurm"},
+			jobDir:  "/sys/fs/cgroup/cpuacct/cluster/slurm/uid_1000/job_42",
+			devices: "/sys/fs/cgroup/devices/cluster/slurm/uid_1000/job_42/devices.list",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rootfs := newTestRootfs(t, map[string]string{
+				tc.devices: "c 195:255 rwm\nc 195:0 rwm\nc 195:2 rwm\n",
+			})
+			cfg := newTestConfig(t, tc.args...)
+			job := slurmJob{ID: "42", UID: "1000", Dir: filepath.Join(rootfs, tc.jobDir)}
+			minors, err := jobGPUMinors(cfg, job)
+			if err != nil || !reflect.DeepEqual(minors, []string{"0", "2"}) {
+				t.Errorf("jobGPUMinors() = %v, %v, want [0 2]", minors, err)
+			}
+		})
+	}
+
+	rootfs := newTestRootfs(t, nil)
+	job := slurmJob{ID: "42", UID: "1000", Dir: filepath.Join(rootfs, testJobDir)}
+	if _, err := jobGPUMinors(newTestConfig(t), job); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("jobGPUMinors() without devices.list = %v, want a not exist error", err)
+	}
+}
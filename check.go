@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// checkResult is the outcome of a single environment check.
+type checkResult struct {
+	name   string
+	ok     bool
+	detail string
+}
+
+// runCheck validates that the environment provides everything the collectors
+// need, prints a report to stdout and returns false if any check failed.
+func runCheck(cfg *Config) bool {
+	results := []checkResult{
+		checkJobsRoot(cfg),
+		checkCgroupVersion(),
+		checkNvidiaSMI(cfg),
+		checkIOSource(cfg),
+	}
+
+	ok := true
+	for _, r := range results {
+		status := "OK"
+		if !r.ok {
+			status = "FAIL"
+			ok = false
+		}
+		fmt.Printf("[%-4s] %s: %s\n", status, r.name, r.detail)
+	}
+	return ok
+}
+
+// checkJobsRoot checks the root of the job cgroups of -workload.manager.
+func checkJobsRoot(cfg *Config) checkResult {
+	if cfg.Workload.Manager == "kubernetes" {
+		return checkKubepodsRoot()
+	}
+	return checkCgroupRoot(cfg)
+}
+
+// waitUntilReady polls the job cgroup root and nvidia-smi every second until
+// both are ready, timeout has passed or ctx is cancelled, so that on a
+// booting node collection doesn't start before Slurm and the NVIDIA driver
+// are up. It returns the last result of the root check.
+func waitUntilReady(ctx context.Context, cfg *Config, clk clock, timeout time.Duration) checkResult {
+	deadline := clk.Now().Add(timeout)
+	for {
+		root, smi := checkJobsRoot(cfg), checkNvidiaSMI(cfg)
+		if (root.ok && smi.ok) || !clk.Now().Before(deadline) {
+			if !smi.ok {
+				fmt.Printf("WARN: %s not ready after %s: %s\n", smi.name, timeout, smi.detail)
+			}
+			return root
+		}
+		select {
+		case <-ctx.Done():
+			return root
+		case <-clk.After(time.Second):
+		}
+	}
+}
+
+// checkCgroupRoot passes if any root of -cgroup.slurm-paths is a directory.
+func checkCgroupRoot(cfg *Config) checkResult {
+	r := checkResult{name: "cgroup root"}
+	var found, problems []string
+	for _, root := range cfg.Cgroup.SlurmPaths {
+		info, err := os.Stat(hostPath(root))
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("%s is not accessible: %v", root, err))
+		case !info.IsDir():
+			problems = append(problems, fmt.Sprintf("%s is not a directory", root))
+		default:
+			found = append(found, root)
+		}
+	}
+	if len(found) == 0 {
+		r.detail = strings.Join(problems, "; ")
+		return r
+	}
+	r.ok = true
+	r.detail = fmt.Sprintf("%s exists", strings.Join(found, ", "))
+	return r
+}
+
+// checkCgroupVersion reports the cgroup hierarchy of the host. A unified
+// (v2) hierarchy exposes cgroup.controllers at the mount root. Jobs are found
+// on both, but the GPUs allocated to jobs are only read from the v1 devices
+// controller.
+func checkCgroupVersion() checkResult {
+	r := checkResult{name: "cgroup version", ok: true}
+	if _, err := os.Stat(hostPath("/sys/fs/cgroup/cgroup.controllers")); err == nil {
+		r.detail = "unified cgroup v2 hierarchy"
+		return r
+	}
+	r.detail = "cgroup v1"
+	return r
+}
+
+// checkNvidiaSMI checks that nvidia-smi lists the GPUs, or that the
+// -gpu.fixture-file that replaces it can be parsed.
+func checkNvidiaSMI(cfg *Config) checkResult {
+	if cfg.GPU.FixtureFile != "" {
+		r := checkResult{name: "gpu fixture"}
+		gpus, err := newFixtureSource(cfg.GPU.FixtureFile).queryGPUs(context.Background())
+		if err != nil {
+			r.detail = err.Error()
+			return r
+		}
+		r.ok = true
+		r.detail = fmt.Sprintf("%s lists %d GPU(s)", cfg.GPU.FixtureFile, len(gpus))
+		return r
+	}
+
+	r := checkResult{name: "nvidia-smi"}
+	path, err := exec.LookPath("nvidia-smi")
+	if err != nil {
+		r.detail = fmt.Sprintf("not found in PATH: %v", err)
+		return r
+	}
+	out, err := exec.Command(path, "-L").Output()
+	if err != nil {
+		r.detail = fmt.Sprintf("%s -L failed: %v", path, err)
+		return r
+	}
+	gpus := 0
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "GPU ") {
+			gpus++
+		}
+	}
+	r.ok = true
+	r.detail = fmt.Sprintf("%s lists %d GPU(s)", path, gpus)
+	return r
+}
+
+// checkIOSource checks what the -io.source in use reads from.
+func checkIOSource(cfg *Config) checkResult {
+	if resolveIOSource(cfg.IO.Source) == "proc" {
+		return checkProcIO(cfg)
+	}
+	r := checkResult{name: "cgroup io controller"}
+	if !ioControllerAvailable() {
+		r.detail = fmt.Sprintf("io is not listed in %s", filepath.Join(cgroupV2Root(), "cgroup.controllers"))
+		return r
+	}
+	r.ok = true
+	r.detail = "io controller available"
+	return r
+}
+
+// checkProcIO reads /proc/<pid>/io for a PID belonging to a running job, which
+// exercises the privileges needed to read other users' processes. When no job
+// is running it falls back to the exporter's own PID.
+func checkProcIO(cfg *Config) checkResult {
+	r := checkResult{name: "/proc/<pid>/io"}
+	pid := findJobPID(cfg)
+	if pid == "" {
+		pid = "self"
+	}
+	path := hostPath(fmt.Sprintf("/proc/%s/io", pid))
+	if _, err := os.ReadFile(path); err != nil {
+		r.detail = fmt.Sprintf("cannot read %s: %v", path, err)
+		return r
+	}
+	r.ok = true
+	r.detail = fmt.Sprintf("%s is readable", path)
+	if pid == "self" {
+		r.detail += " (no job PIDs found to test against)"
+	}
+	return r
+}
+
+// findJobPID returns the first PID of a running job, found in the job cgroups
+// the collectors would walk, or an empty string if there is none.
+func findJobPID(cfg *Config) string {
+	ctx := context.Background()
+	if cfg.Workload.Manager == "kubernetes" {
+		pods, _ := walkKubernetesPods(ctx)
+		for _, pod := range pods {
+			if len(pod.PIDs) > 0 {
+				return pod.PIDs[0]
+			}
+		}
+		return ""
+	}
+	for _, root := range cfg.Cgroup.SlurmPaths {
+		dirs, _ := findSlurmJobDirs(ctx, cfg.Cgroup.slurmJobPatterns, hostPath(root))
+		for _, dir := range dirs {
+			if pids, _, err := readCgroupTree(dir.path); err == nil && len(pids) > 0 {
+				return pids[0]
+			}
+		}
+	}
+	return ""
+}
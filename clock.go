@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// clockStepThreshold is how far the wall clock may drift from the monotonic
+// clock between two cycles before it counts as stepped. NTP slewing stays
+// well below it.
+const clockStepThreshold = time.Second
+
+// clock is where the exporter reads the time from and gets its tickers and
+// timers, so that time-dependent behavior such as rates, staleness and
+// expiry can be driven by a fake clock instead of real sleeps.
+type clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) ticker
+	After(d time.Duration) <-chan time.Time
+}
+
+// ticker is the part of *time.Ticker the exporter uses.
+type ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTicker(d time.Duration) ticker { return realTicker{time.NewTicker(d)} }
+
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// maxElapsedIntervals is how many collection intervals elapsedSeconds credits
+// to a single cycle at most. A longer gap, e.g. after the host was suspended
+// or a loop stalled, would otherwise attribute what one cycle sampled to all
+// of it.
+const maxElapsedIntervals = 5
+
+// elapsedSeconds returns the seconds from last to now, the interval the
+// rates and accumulated counters are computed over, or 0 if there is no last
+// time or now isn't after it. It is capped at maxElapsedIntervals times
+// interval, the interval of the collecting loop; 0 leaves it uncapped. Times
+// read from the real clock carry a monotonic reading, which the difference
+// uses, so wall clock steps don't affect it.
+func elapsedSeconds(last, now time.Time, interval time.Duration) float64 {
+	if last.IsZero() {
+		return 0
+	}
+	elapsed := now.Sub(last)
+	if interval > 0 {
+		elapsed = min(elapsed, maxElapsedIntervals*interval)
+	}
+	return max(elapsed.Seconds(), 0)
+}
+
+// clockWatch detects the clock misbehaving between collection cycles: time
+// going backwards, or the wall clock being stepped, e.g. by NTP or an
+// operator, which shifts the timestamps of everything read from the wall
+// clock, such as process start times and the last collection time.
+type clockWatch struct {
+	anomalies prometheus.Counter
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+// newClockWatch creates the anomaly counter and registers it with reg.
+func newClockWatch(reg prometheus.Registerer) *clockWatch {
+	w := &clockWatch{
+		anomalies: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "job_exporter_clock_anomalies_total",
+			Help: "Number of times the clock went backwards or the wall clock was stepped between collection cycles.",
+		}),
+	}
+	register(reg, w.anomalies)
+	return w
+}
+
+// check compares the time a cycle starts at, read from clk, with the start of
+// the previous cycle, of any loop. The time is read under the lock: read
+// before it, a loop preempted between reading and locking would hand in a
+// time older than the other loop's, which would count as going backwards.
+func (w *clockWatch) check(clk clock) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := clk.Now()
+	last := w.last
+	w.last = now
+	if last.IsZero() {
+		return
+	}
+	elapsed := now.Sub(last)
+	// Round(0) strips the monotonic reading, leaving the wall clock.
+	step := now.Round(0).Sub(last.Round(0)) - elapsed
+	switch {
+	case elapsed < 0:
+		fmt.Printf("WARN: Time went backwards by %s since the previous cycle\n", -elapsed)
+		w.anomalies.Inc()
+	case step > clockStepThreshold || step < -clockStepThreshold:
+		fmt.Printf("WARN: Wall clock stepped by %s since the previous cycle, rates are unaffected\n", step)
+		w.anomalies.Inc()
+	}
+}
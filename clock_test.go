@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeClock is a clock whose time only moves when the test advances it.
+// Its tickers and timers never fire.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) NewTicker(d time.Duration) ticker { return fakeTicker{} }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time { return nil }
+
+// advance moves the time of c forward by d.
+func (c *fakeClock) advance(d time.Duration) { c.now = c.now.Add(d) }
+
+type fakeTicker struct{}
+
+func (fakeTicker) C() <-chan time.Time { return nil }
+
+func (fakeTicker) Stop() {}
+
+func TestClockWatchCountsTimeGoingBackwards(t *testing.T) {
+	w := newTestMetrics(newTestConfig(t)).clockWatch
+	clk := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+
+	w.check(clk)
+	clk.advance(2 * time.Second)
+	w.check(clk)
+	if got := testutil.ToFloat64(w.anomalies); got != 0 {
+		t.Errorf("job_exporter_clock_anomalies_total = %v after the clock moved forward, want 0", got)
+	}
+
+	clk.advance(-time.Second)
+	w.check(clk)
+	if got := testutil.ToFloat64(w.anomalies); got != 1 {
+		t.Errorf("job_exporter_clock_anomalies_total = %v after the clock went backwards, want 1", got)
+	}
+}
+
+func TestElapsedSecondsCapped(t *testing.T) {
+	clk := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	g := newTestMetrics(newTestConfig(t, "-gpu.interval=2s")).jobGPUSeconds
+	jobIDs := map[string]struct{}{"42": {}}
+	shares := map[string]float64{"42": 100}
+
+	g.update(jobIDs, shares, clk.Now())
+	clk.advance(2 * time.Second)
+	g.update(jobIDs, shares, clk.Now())
+	// As after the host was suspended for an hour.
+	clk.advance(time.Hour)
+	g.update(jobIDs, shares, clk.Now())
+
+	if got, want := testutil.ToFloat64(g.seconds.WithLabelValues("42")), float64(2+maxElapsedIntervals*2); got != want {
+		t.Errorf("job_gpu_seconds_total{job_id=\"42\"} = %v, want %v", got, want)
+	}
+	if got := elapsedSeconds(time.Time{}, clk.Now(), 2*time.Second); got != 0 {
+		t.Errorf("elapsedSeconds() without a last time = %v, want 0", got)
+	}
+	if got := elapsedSeconds(clk.Now(), clk.Now().Add(time.Hour), 0); got != 3600 {
+		t.Errorf("elapsedSeconds() uncapped = %v, want 3600", got)
+	}
+}
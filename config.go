@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the exporter's tunables. Every field can be set in the YAML
+// file given by -config.file, using the dotted flag name as the key path
+// (e.g. otlp.interval), or by the flag itself. Flags take precedence over the
+// file.
+type Config struct {
+	// ConfigFile, Check and Lint only make sense on the command line.
+	ConfigFile string `yaml:"-"`
+	Check      bool   `yaml:"-"`
+	Lint       bool   `yaml:"-"`
+
+	// Mode is exporter, collecting on this node, or aggregator, merging the
+	// metrics of Peers.
+	Mode  string     `yaml:"mode"`
+	Peers stringList `yaml:"peers"`
+	// ScrapeMode is interval, collecting on background tickers, or scrape,
+	// collecting when the metrics are gathered.
+	ScrapeMode string `yaml:"scrape-mode"`
+
+	Output      OutputConfig      `yaml:"output"`
+	OTLP        OTLPConfig        `yaml:"otlp"`
+	Pushgateway PushgatewayConfig `yaml:"pushgateway"`
+	Slurm       SlurmConfig       `yaml:"slurm"`
+	GPU         GPUConfig         `yaml:"gpu"`
+	Metrics     MetricsConfig     `yaml:"metrics"`
+	Web         WebConfig         `yaml:"web"`
+	Collector   CollectorConfig   `yaml:"collector"`
+	Label       LabelConfig       `yaml:"label"`
+	IO          IOConfig          `yaml:"io"`
+	Cgroup      CgroupConfig      `yaml:"cgroup"`
+	Log         LogConfig         `yaml:"log"`
+	Debug       DebugConfig       `yaml:"debug"`
+	Startup     StartupConfig     `yaml:"startup"`
+	Scratch     ScratchConfig     `yaml:"scratch"`
+	Workload    WorkloadConfig    `yaml:"workload"`
+}
+
+// OutputConfig selects how metrics leave the exporter.
+type OutputConfig struct {
+	Mode string `yaml:"mode"`
+}
+
+// OTLPConfig configures the OTLP push export.
+type OTLPConfig struct {
+	Endpoint string        `yaml:"endpoint"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// PushgatewayConfig configures the push of a final snapshot on shutdown.
+type PushgatewayConfig struct {
+	URL string `yaml:"url"`
+}
+
+// SlurmConfig controls how the Slurm cgroup hierarchy is walked.
+type SlurmConfig struct {
+	IncludeUIDs stringList    `yaml:"include-uids"`
+	ExcludeUIDs stringList    `yaml:"exclude-uids"`
+	ScanThreads bool          `yaml:"scan-threads"`
+	Enrich      bool          `yaml:"enrich"`
+	EnrichTTL   time.Duration `yaml:"enrich-ttl"`
+}
+
+// walksUID reports whether the uid_<uid> directory for uid should be walked.
+// An empty include list allows every UID that isn't excluded.
+func (c SlurmConfig) walksUID(uid string) bool {
+	if len(c.IncludeUIDs) > 0 && !c.IncludeUIDs.contains(uid) {
+		return false
+	}
+	return !c.ExcludeUIDs.contains(uid)
+}
+
+// GPUConfig controls how GPU metrics are collected.
+type GPUConfig struct {
+	Backend       string        `yaml:"backend"`
+	DCGMHost      string        `yaml:"dcgm-host"`
+	Mode          string        `yaml:"mode"`
+	Query         stringList    `yaml:"query"`
+	ExpectedCount int           `yaml:"expected-count"`
+	Exclude       stringList    `yaml:"exclude"`
+	UnmanagedJob  string        `yaml:"unmanaged-job"`
+	Interval      time.Duration `yaml:"interval"`
+
+	FixtureFile     string `yaml:"fixture-file"`
+	AppsFixtureFile string `yaml:"apps-fixture-file"`
+
+	TopologyFile string `yaml:"topology-file"`
+	OnlyActive   bool   `yaml:"only-active"`
+	// topology is TopologyFile read by validate, or nil.
+	topology *gpuTopology
+}
+
+// excludes reports whether -gpu.exclude lists the GPU by index or UUID.
+func (c GPUConfig) excludes(index, uuid string) bool {
+	return c.Exclude.contains(index) || (uuid != "" && c.Exclude.contains(uuid))
+}
+
+// MetricsConfig controls what the exporter exposes.
+type MetricsConfig struct {
+	MaxSeries      int        `yaml:"max-series"`
+	MemoryUnit     string     `yaml:"memory-unit"`
+	Granularity    string     `yaml:"granularity"`
+	LegacyIOGauges bool       `yaml:"legacy-io-gauges"`
+	Disable        stringList `yaml:"disable"`
+}
+
+// WebConfig controls the HTTP endpoint serving metrics.
+type WebConfig struct {
+	TelemetryPath   string `yaml:"telemetry-path"`
+	TLSCertFile     string `yaml:"tls-cert-file"`
+	TLSKeyFile      string `yaml:"tls-key-file"`
+	TLSClientCAFile string `yaml:"tls-client-ca-file"`
+
+	ReadHeaderTimeout time.Duration `yaml:"read-header-timeout"`
+	ReadTimeout       time.Duration `yaml:"read-timeout"`
+	WriteTimeout      time.Duration `yaml:"write-timeout"`
+	IdleTimeout       time.Duration `yaml:"idle-timeout"`
+	MaxHeaderBytes    int           `yaml:"max-header-bytes"`
+}
+
+// CollectorConfig enables optional collectors and tunes collection.
+type CollectorConfig struct {
+	Network            bool          `yaml:"network"`
+	GPUAccounting      bool          `yaml:"gpu-accounting"`
+	ProcessUtilization bool          `yaml:"process-utilization"`
+	IOStat             bool          `yaml:"io-stat"`
+	IOStatDevices      bool          `yaml:"io-stat-devices"`
+	OOMKills           bool          `yaml:"oom-kills"`
+	Jitter             time.Duration `yaml:"jitter"`
+}
+
+// LabelConfig selects the job metadata labels that are exposed and how job
+// directory names become job_id labels.
+type LabelConfig struct {
+	Keep                stringList `yaml:"keep"`
+	Drop                stringList `yaml:"drop"`
+	JobIDStripArrayTask bool       `yaml:"job-id-strip-array-task"`
+	JobIDRegex          string     `yaml:"job-id-regex"`
+	JobIDValidRegex     string     `yaml:"job-id-valid-regex"`
+	InvalidJobID        string     `yaml:"invalid-job-id"`
+	Extra               stringList `yaml:"extra"`
+
+	// jobIDPattern is JobIDRegex compiled by validate, and
+	// jobIDValidPattern JobIDValidRegex.
+	jobIDPattern      *regexp.Regexp
+	jobIDValidPattern *regexp.Regexp
+	// extra is Extra parsed by validate, with environment variables
+	// expanded.
+	extra map[string]string
+}
+
+// labelNamePattern matches valid Prometheus label names.
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// exporterLabelNames are the labels of the exporter's own metrics, which
+// -label.extra can't override.
+var exporterLabelNames = stringList{"job_id", "gpu_id", "pid", "type", "mode", "collector", "metric", "source", "device", "node", "reason", "driver_version", "cuda_version", "state"}
+
+// jobID returns the job_id label of the Slurm job whose cgroup directory is
+// job_<id>. An id that doesn't match -label.job-id-valid-regex, e.g. from a
+// sibling directory another tool created, is replaced by
+// -label.invalid-job-id, and ok is false if that is empty. A valid id is
+// stripped of its array task suffix with -label.job-id-strip-array-task,
+// then replaced by the first group captured by -label.job-id-regex if it
+// matches.
+func (c LabelConfig) jobID(id string) (label string, ok bool) {
+	if c.jobIDValidPattern != nil && !c.jobIDValidPattern.MatchString(id) {
+		debugf("Job ID %q doesn't match label.job-id-valid-regex", id)
+		return c.InvalidJobID, c.InvalidJobID != ""
+	}
+	if c.JobIDStripArrayTask {
+		id, _, _ = strings.Cut(id, "_")
+	}
+	if c.jobIDPattern != nil {
+		if match := c.jobIDPattern.FindStringSubmatch(id); match != nil {
+			id = match[1]
+		}
+	}
+	return id, true
+}
+
+// WorkloadConfig selects where jobs come from.
+type WorkloadConfig struct {
+	Manager string `yaml:"manager"`
+}
+
+// LogConfig controls logging.
+type LogConfig struct {
+	Debug bool `yaml:"debug"`
+}
+
+// IOConfig controls the collection of the job cgroups and their IO.
+type IOConfig struct {
+	Interval        time.Duration `yaml:"interval"`
+	MinPIDAge       time.Duration `yaml:"min-pid-age"`
+	Source          string        `yaml:"source"`
+	ReadConcurrency int           `yaml:"read-concurrency"`
+}
+
+// CgroupConfig locates the job cgroups.
+type CgroupConfig struct {
+	SlurmPaths       stringList `yaml:"slurm-paths"`
+	SlurmJobPatterns stringList `yaml:"slurm-job-patterns"`
+
+	// slurmJobPatterns is SlurmJobPatterns compiled by validate.
+	slurmJobPatterns []*regexp.Regexp
+}
+
+// StartupConfig controls how the exporter waits for its environment.
+type StartupConfig struct {
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// ScratchConfig locates the scratch directories of jobs and bounds their
+// walk.
+type ScratchConfig struct {
+	Path     string        `yaml:"path"`
+	MaxDepth int           `yaml:"max-depth"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// DebugConfig controls the debugging endpoints.
+type DebugConfig struct {
+	Endpoints bool `yaml:"endpoints"`
+}
+
+// stringList is a comma-separated list flag. Set replaces the whole list so
+// the command line can safely be parsed more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+func (l stringList) contains(value string) bool {
+	for _, item := range l {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// hiddenFlags are the developer flags left out of -help.
+var hiddenFlags = stringList{"lint"}
+
+// printUsage prints the usage of the flags of fs like flag.PrintDefaults,
+// without hiddenFlags.
+func printUsage(fs *flag.FlagSet) {
+	fmt.Fprintf(fs.Output(), "Usage of %s:\n", fs.Name())
+	visible := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	visible.SetOutput(fs.Output())
+	fs.VisitAll(func(f *flag.Flag) {
+		if !hiddenFlags.contains(f.Name) {
+			visible.Var(f.Value, f.Name, f.Usage)
+			// Var takes the default from the value, which holds what was
+			// parsed so far, e.g. from -config.file, when -help comes last.
+			visible.Lookup(f.Name).DefValue = f.DefValue
+		}
+	})
+	visible.PrintDefaults()
+}
+
+// registerFlags binds a flag to each field of c, which also sets the
+// defaults.
+func (c *Config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ConfigFile, "config.file", "", "Path to a YAML configuration file. Flags take precedence over values in the file.")
+	fs.BoolVar(&c.Check, "check", false, "Validate the environment, print a report and exit.")
+	fs.BoolVar(&c.Lint, "lint", false, "Run a collection cycle, check the exposed metrics against the Prometheus naming conventions with promlint, print the problems and exit, nonzero if there are any. A developer aid, hidden from -help.")
+	fs.StringVar(&c.Mode, "mode", "exporter", "exporter (collect metrics on this node) or aggregator (scrape the exporters in -peers and expose their merged metrics with a node label).")
+	fs.Var(&c.Peers, "peers", "Comma-separated metrics URLs of the exporters to aggregate with -mode=aggregator, e.g. http://node1:9060/metrics.")
+	fs.StringVar(&c.ScrapeMode, "scrape-mode", "interval", "When metrics are collected: interval (in the background every -gpu.interval and -io.interval) or scrape (on each request to the metrics endpoint, so they are always fresh at the cost of slower scrapes).")
+	fs.StringVar(&c.Output.Mode, "output.mode", "prometheus", "How metrics are exported: prometheus (serve /metrics) or otlp (push to -otlp.endpoint).")
+	fs.StringVar(&c.OTLP.Endpoint, "otlp.endpoint", "http://localhost:4318/v1/metrics", "OTLP/HTTP metrics endpoint URL used when -output.mode=otlp.")
+	fs.DurationVar(&c.OTLP.Interval, "otlp.interval", 60*time.Second, "How often metrics are pushed when -output.mode=otlp.")
+	fs.StringVar(&c.Pushgateway.URL, "pushgateway.url", "", "Pushgateway URL to push a final snapshot of the metrics to on shutdown, after one last collection cycle, e.g. before a node drain. Empty disables the push.")
+	fs.StringVar(&c.Workload.Manager, "workload.manager", "slurm", "What the job_id label identifies: slurm (Slurm jobs from the Slurm cgroup hierarchy) or kubernetes (pod UIDs from the kubepods cgroup hierarchy).")
+	fs.Var(&c.Slurm.IncludeUIDs, "slurm.include-uids", "Comma-separated UIDs whose jobs are collected. Empty means all UIDs.")
+	fs.Var(&c.Slurm.ExcludeUIDs, "slurm.exclude-uids", "Comma-separated UIDs whose jobs are never collected, e.g. service accounts.")
+	fs.StringVar(&c.Web.TelemetryPath, "web.telemetry-path", "/metrics", "Path under which metrics are served.")
+	fs.StringVar(&c.Web.TLSCertFile, "web.tls-cert-file", "", "PEM certificate to serve metrics over HTTPS with. Requires -web.tls-key-file.")
+	fs.StringVar(&c.Web.TLSKeyFile, "web.tls-key-file", "", "PEM private key of -web.tls-cert-file.")
+	fs.StringVar(&c.Web.TLSClientCAFile, "web.tls-client-ca-file", "", "PEM CA certificates client certificates are verified against. When set, clients must present a valid certificate (mutual TLS). Requires -web.tls-cert-file.")
+	fs.DurationVar(&c.Web.ReadHeaderTimeout, "web.read-header-timeout", 10*time.Second, "Maximum time to read the headers of a request. 0 disables the timeout.")
+	fs.DurationVar(&c.Web.ReadTimeout, "web.read-timeout", 30*time.Second, "Maximum time to read a whole request. 0 disables the timeout.")
+	fs.DurationVar(&c.Web.WriteTimeout, "web.write-timeout", 60*time.Second, "Maximum time to answer a request, including the collection cycle with -scrape-mode=scrape. 0 disables the timeout.")
+	fs.DurationVar(&c.Web.IdleTimeout, "web.idle-timeout", 120*time.Second, "Maximum time a keep-alive connection waits for the next request. 0 uses -web.read-timeout.")
+	fs.IntVar(&c.Web.MaxHeaderBytes, "web.max-header-bytes", 64<<10, "Maximum size of the headers of a request in bytes.")
+	fs.IntVar(&c.Metrics.MaxSeries, "metrics.max-series", 10000, "Maximum number of series per job-level metric; new series beyond it are dropped. 0 disables the limit.")
+	fs.StringVar(&c.Metrics.Granularity, "metrics.granularity", "pid", "Label sets of the per-process metrics: pid for per-process series, job for per-job sums only, or both.")
+	fs.BoolVar(&c.Metrics.LegacyIOGauges, "metrics.legacy-io-gauges", false, "Expose the per-process IO totals as the deprecated io_read_bytes and io_write_bytes gauges instead of the io_read_bytes_total and io_write_bytes_total counters. Will be removed in a future release.")
+	fs.Var(&c.Metrics.Disable, "metrics.disable", "Comma-separated names of metrics to never expose, e.g. high-cardinality ones such as io_read_bytes_total.")
+	fs.StringVar(&c.Metrics.MemoryUnit, "metrics.memory-unit", "bytes", "Unit of the GPU memory metrics: bytes, or mib for the nvidia-smi unit, which renames their _bytes suffix to _mebibytes.")
+	fs.BoolVar(&c.Slurm.ScanThreads, "slurm.scan-threads", false, "Also match GPU processes against each job's thread list (cgroup.threads or tasks), for jobs whose task PIDs aren't in cgroup.procs.")
+	fs.BoolVar(&c.Slurm.Enrich, "slurm.enrich", false, "Expose job_info with each job's user, account and partition from scontrol.")
+	fs.DurationVar(&c.Slurm.EnrichTTL, "slurm.enrich-ttl", 5*time.Minute, "How long a job's scontrol metadata is cached before it is fetched again.")
+	fs.Var(&c.Label.Keep, "label.keep", "Comma-separated job metadata labels to expose with -slurm.enrich (user, account, partition, job_name). Empty means all.")
+	fs.Var(&c.Label.Drop, "label.drop", "Comma-separated job metadata labels not to expose with -slurm.enrich, e.g. user.")
+	fs.BoolVar(&c.Label.JobIDStripArrayTask, "label.job-id-strip-array-task", false, "Strip the array task suffix from Slurm job IDs, e.g. 1234_7 becomes 1234. The tasks of an array then share their series.")
+	fs.StringVar(&c.Label.JobIDRegex, "label.job-id-regex", "", "Regular expression with one capture group applied to Slurm job IDs; the job_id label is the captured group, e.g. ^0*([0-9]+)$ strips leading zeros. IDs that don't match are kept.")
+	fs.StringVar(&c.Label.JobIDValidRegex, "label.job-id-valid-regex", `^[0-9]+(_[0-9]+)?$`, "Regular expression Slurm job IDs, from job_<id> cgroup directories, must match. Others are reported as -label.invalid-job-id. Empty accepts every ID.")
+	fs.StringVar(&c.Label.InvalidJobID, "label.invalid-job-id", "invalid", "job_id of the cgroup directories whose ID doesn't match -label.job-id-valid-regex. Empty skips them.")
+	fs.Var(&c.Label.Extra, "label.extra", "Comma-separated name=value labels added to every metric, e.g. cluster=${CLUSTER},rack=r12 to identify the node. $VAR and ${VAR} in values are replaced by environment variables, e.g. set by provisioning or Slurm.")
+	fs.BoolVar(&c.Collector.Network, "collector.network", false, "Expose per-job network bytes from /proc/<pid>/net/dev. Approximate for jobs sharing the host network namespace, see README.")
+	fs.BoolVar(&c.Collector.ProcessUtilization, "collector.process-utilization", false, "Split job_gpu_utilization_percent between the jobs sharing a GPU by the SM utilization of their processes, sampled with nvidia-smi pmon, rather than equally. Adds about a second to every cycle.")
+	fs.BoolVar(&c.Collector.IOStat, "collector.io-stat", false, "Expose job_io_read_bytes_total and job_io_write_bytes_total from the io.stat of each job's cgroup v2 directory.")
+	fs.BoolVar(&c.Collector.IOStatDevices, "collector.io-stat-devices", false, "Label the io.stat metrics by block device.")
+	fs.BoolVar(&c.Collector.OOMKills, "collector.oom-kills", false, "Expose job_memory_oom_kills_total from the memory cgroup of each job.")
+	fs.BoolVar(&c.Collector.GPUAccounting, "collector.gpu-accounting", false, "Enable NVML accounting mode and expose per-job lifetime GPU utilization and peak memory, including processes that exited between cycles.")
+	fs.DurationVar(&c.Collector.Jitter, "collector.jitter", 0, "Maximum random delay before the first collection cycle, so nodes started together don't collect in lockstep. 0 disables it.")
+	fs.BoolVar(&c.Log.Debug, "log.debug", false, "Log details of every collection cycle, e.g. compute apps that can't be attributed.")
+	fs.StringVar(&c.Scratch.Path, "scratch.path", "", "Path of the scratch directory of each job, with {job_id} standing for its ID, e.g. /scratch/{job_id}, whose disk usage is exposed as job_scratch_bytes. Empty disables it.")
+	fs.IntVar(&c.Scratch.MaxDepth, "scratch.max-depth", 16, "How many directory levels below a scratch directory are walked for its usage.")
+	fs.DurationVar(&c.Scratch.Timeout, "scratch.timeout", 5*time.Second, "How long the walk of a scratch directory may take, after which the usage found so far is exposed.")
+	fs.DurationVar(&c.Startup.Timeout, "startup.timeout", 0, "How long to wait at startup for the job cgroup root and nvidia-smi to be ready, e.g. while the node boots, before collecting. 0 doesn't wait.")
+	fs.BoolVar(&c.Debug.Endpoints, "debug.endpoints", false, "Serve /debug/jobs, the jobs found by the last cycle with their UIDs, PIDs and GPUs as JSON, and /debug/errors, the last collection errors. Exposes process information.")
+	fs.StringVar(&c.GPU.Backend, "gpu.backend", "nvidia-smi", "Where device-level GPU state is read from: nvidia-smi, or dcgm (dcgmi dmon, adds profiling metrics; requires nv-hostengine).")
+	fs.StringVar(&c.GPU.DCGMHost, "gpu.dcgm-host", "", "nv-hostengine to stream from with -gpu.backend=dcgm: host[:port], or unix://<path> for a hostengine listening on a Unix socket. Empty uses the local hostengine on its default port.")
+	fs.StringVar(&c.GPU.FixtureFile, "gpu.fixture-file", "", "Read the device-level GPU state from this file of nvidia-smi --query-gpu=<fields> --format=csv,nounits output instead of running nvidia-smi, e.g. to run without GPUs in CI.")
+	fs.StringVar(&c.GPU.AppsFixtureFile, "gpu.apps-fixture-file", "", "Read the compute apps from this file of nvidia-smi --query-compute-apps=pid,used_gpu_memory,gpu_uuid --format=csv,noheader output instead of running nvidia-smi. Without it, gpu.fixture-file implies no compute apps.")
+	fs.StringVar(&c.GPU.TopologyFile, "gpu.topology-file", "", "CSV file mapping GPUs, by index or uuid in the first column, to site-specific labels such as slot or rack in the others, which are added to the device-level GPU metrics.")
+	fs.BoolVar(&c.GPU.OnlyActive, "gpu.only-active", false, "Omit the per-GPU gauges, e.g. of memory and temperature, of GPUs at 0% utilization without compute apps, to save storage on large nodes. Disables idle allocated GPU detection.")
+	c.Cgroup.SlurmPaths = stringList{slurmCgroupPath}
+	fs.Var(&c.Cgroup.SlurmPaths, "cgroup.slurm-paths", "Comma-separated roots of the Slurm job cgroups, e.g. /sys/fs/cgroup/system.slice on cgroup v2, or several on mixed or transitional cgroup setups. Jobs found under several roots are reported once.")
+	c.Cgroup.SlurmJobPatterns = append(stringList(nil), defaultSlurmJobPatterns...)
+	fs.Var(&c.Cgroup.SlurmJobPatterns, "cgroup.slurm-job-patterns", "Comma-separated regular expressions matching the paths of the Slurm job directories relative to a root of cgroup.slurm-paths, capturing the job ID in a (?P<job>...) group and optionally the owner in a (?P<uid>...) group. The default matches the cgroup v1 and v2 layouts of the Slurm releases in use.")
+	c.GPU.Query = append(stringList(nil), gpuDefaultQueryFields...)
+	fs.Var(&c.GPU.Query, "gpu.query", "Comma-separated nvidia-smi --query-gpu fields to expose, see README for the supported ones. gpu_uuid, index and utilization.gpu are always queried.")
+	fs.IntVar(&c.GPU.ExpectedCount, "gpu.expected-count", 0, "Number of GPUs the node should have, reported as gpu_present 0 while missing. 0 expects the GPUs seen since startup.")
+	fs.DurationVar(&c.GPU.Interval, "gpu.interval", 2*time.Second, "Interval between GPU collection cycles.")
+	fs.DurationVar(&c.IO.Interval, "io.interval", 2*time.Second, "Interval between collection cycles of the job cgroups, their IO and the collectors that need the job list (slurm enrichment, accounting, network, io.stat, runtime).")
+	fs.StringVar(&c.IO.Source, "io.source", "proc", "Where the IO of jobs is read from: proc (per-process /proc/<pid>/io), cgroup (the io.stat of each job's cgroup v2 directory) or auto (cgroup if the io controller is available, proc otherwise).")
+	fs.DurationVar(&c.IO.MinPIDAge, "io.min-pid-age", 0, "Skip the IO of processes younger than this, e.g. short-lived helpers a job spawns by the thousand. 0 reads every process.")
+	fs.IntVar(&c.IO.ReadConcurrency, "io.read-concurrency", 8, "Number of /proc/<pid>/io files read in parallel, which shortens cycles on jobs with thousands of processes.")
+	fs.StringVar(&c.GPU.UnmanagedJob, "gpu.unmanaged-job", "unmanaged", "job_id of the GPU usage of processes that belong to no job, e.g. debugging sessions or system daemons. Empty drops it.")
+	fs.Var(&c.GPU.Exclude, "gpu.exclude", "Comma-separated indexes or UUIDs of GPUs to leave out of collection, e.g. GPUs reserved for the display.")
+	fs.StringVar(&c.GPU.Mode, "gpu.mode", "query", "How the nvidia-smi backend reads device-level GPU state: query (run nvidia-smi --query-gpu every cycle) or dmon (stream samples from a long-lived nvidia-smi dmon).")
+}
+
+// loadFile decodes the YAML file at path into c. Unknown keys are rejected so
+// typos don't silently fall back to defaults.
+func (c *Config) loadFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	switch c.Mode {
+	case "exporter":
+	case "aggregator":
+		if len(c.Peers) == 0 {
+			return fmt.Errorf("mode aggregator requires peers")
+		}
+		for _, peer := range c.Peers {
+			if u, err := url.Parse(peer); err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("invalid peer URL %q, expected e.g. http://node1:9060/metrics", peer)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown mode %q, expected exporter or aggregator", c.Mode)
+	}
+	switch c.ScrapeMode {
+	case "interval", "scrape":
+	default:
+		return fmt.Errorf("unknown scrape-mode %q, expected interval or scrape", c.ScrapeMode)
+	}
+	if c.Pushgateway.URL != "" {
+		if u, err := url.Parse(c.Pushgateway.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid pushgateway.url %q, expected e.g. http://pushgateway:9091", c.Pushgateway.URL)
+		}
+	}
+	switch c.Output.Mode {
+	case "prometheus", "otlp":
+	default:
+		return fmt.Errorf("unknown output.mode %q, expected prometheus or otlp", c.Output.Mode)
+	}
+	if !strings.HasPrefix(c.Web.TelemetryPath, "/") || c.Web.TelemetryPath == "/" {
+		return fmt.Errorf("web.telemetry-path must start with / and must not be the root path, got %q", c.Web.TelemetryPath)
+	}
+	if (c.Web.TLSCertFile == "") != (c.Web.TLSKeyFile == "") {
+		return fmt.Errorf("web.tls-cert-file and web.tls-key-file must be set together")
+	}
+	for _, timeout := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"web.read-header-timeout", c.Web.ReadHeaderTimeout},
+		{"web.read-timeout", c.Web.ReadTimeout},
+		{"web.write-timeout", c.Web.WriteTimeout},
+		{"web.idle-timeout", c.Web.IdleTimeout},
+	} {
+		if timeout.value < 0 {
+			return fmt.Errorf("%s must not be negative", timeout.name)
+		}
+	}
+	if c.Web.MaxHeaderBytes <= 0 {
+		return fmt.Errorf("web.max-header-bytes must be positive")
+	}
+	if c.Web.TLSClientCAFile != "" && c.Web.TLSCertFile == "" {
+		return fmt.Errorf("web.tls-client-ca-file requires web.tls-cert-file")
+	}
+	if c.Metrics.MaxSeries < 0 {
+		return fmt.Errorf("metrics.max-series must not be negative")
+	}
+	switch c.Metrics.Granularity {
+	case "job", "pid", "both":
+	default:
+		return fmt.Errorf("unknown metrics.granularity %q, expected job, pid or both", c.Metrics.Granularity)
+	}
+	for _, name := range c.Metrics.Disable {
+		if !knownMetricName(name) {
+			return fmt.Errorf("unknown metric %q in metrics.disable", name)
+		}
+	}
+	switch c.Metrics.MemoryUnit {
+	case "bytes", "mib":
+	default:
+		return fmt.Errorf("unknown metrics.memory-unit %q, expected bytes or mib", c.Metrics.MemoryUnit)
+	}
+	switch c.Workload.Manager {
+	case "slurm":
+	case "kubernetes":
+		if c.Slurm.Enrich {
+			return fmt.Errorf("slurm.enrich requires workload.manager=slurm")
+		}
+	default:
+		return fmt.Errorf("unknown workload.manager %q, expected slurm or kubernetes", c.Workload.Manager)
+	}
+	if c.Collector.Jitter < 0 {
+		return fmt.Errorf("collector.jitter must not be negative")
+	}
+	if c.GPU.Interval <= 0 {
+		return fmt.Errorf("gpu.interval must be positive")
+	}
+	if c.IO.Interval <= 0 {
+		return fmt.Errorf("io.interval must be positive")
+	}
+	switch c.IO.Source {
+	case "auto", "cgroup", "proc":
+	default:
+		return fmt.Errorf("unknown io.source %q, expected auto, cgroup or proc", c.IO.Source)
+	}
+	if c.IO.MinPIDAge < 0 {
+		return fmt.Errorf("io.min-pid-age must not be negative")
+	}
+	if c.IO.ReadConcurrency <= 0 {
+		return fmt.Errorf("io.read-concurrency must be positive")
+	}
+	if c.Startup.Timeout < 0 {
+		return fmt.Errorf("startup.timeout must not be negative")
+	}
+	if c.Collector.IOStatDevices && !c.Collector.IOStat {
+		return fmt.Errorf("collector.io-stat-devices requires collector.io-stat")
+	}
+	if c.Workload.Manager == "slurm" && len(c.Cgroup.SlurmPaths) == 0 {
+		return fmt.Errorf("cgroup.slurm-paths must not be empty")
+	}
+	if c.Scratch.Path != "" && !strings.Contains(c.Scratch.Path, scratchJobIDPlaceholder) {
+		return fmt.Errorf("scratch.path must contain %s", scratchJobIDPlaceholder)
+	}
+	if c.Scratch.MaxDepth < 0 {
+		return fmt.Errorf("scratch.max-depth must not be negative")
+	}
+	if c.Scratch.Timeout <= 0 {
+		return fmt.Errorf("scratch.timeout must be positive")
+	}
+	if c.Workload.Manager == "slurm" && len(c.Cgroup.SlurmJobPatterns) == 0 {
+		return fmt.Errorf("cgroup.slurm-job-patterns must not be empty")
+	}
+	patterns, err := compileSlurmJobPatterns(c.Cgroup.SlurmJobPatterns)
+	if err != nil {
+		return err
+	}
+	c.Cgroup.slurmJobPatterns = patterns
+	if c.GPU.ExpectedCount < 0 {
+		return fmt.Errorf("gpu.expected-count must not be negative")
+	}
+	switch c.GPU.Backend {
+	case "nvidia-smi", "dcgm":
+	default:
+		return fmt.Errorf("unknown gpu.backend %q, expected nvidia-smi or dcgm", c.GPU.Backend)
+	}
+	if c.GPU.DCGMHost != "" && c.GPU.Backend != "dcgm" {
+		return fmt.Errorf("gpu.dcgm-host requires gpu.backend=dcgm")
+	}
+	switch c.GPU.Mode {
+	case "query", "dmon":
+	default:
+		return fmt.Errorf("unknown gpu.mode %q, expected query or dmon", c.GPU.Mode)
+	}
+	if c.GPU.FixtureFile != "" && (c.GPU.Backend != "nvidia-smi" || c.GPU.Mode != "query") {
+		return fmt.Errorf("gpu.fixture-file requires gpu.backend=nvidia-smi and gpu.mode=query")
+	}
+	for _, field := range c.GPU.Query {
+		if !knownGPUQueryField(field) {
+			return fmt.Errorf("unsupported field %q in gpu.query", field)
+		}
+	}
+	for _, uids := range []stringList{c.Slurm.IncludeUIDs, c.Slurm.ExcludeUIDs} {
+		for _, uid := range uids {
+			if _, err := strconv.ParseUint(uid, 10, 32); err != nil {
+				return fmt.Errorf("invalid UID %q in slurm.include-uids or slurm.exclude-uids", uid)
+			}
+		}
+	}
+	if len(c.Label.Keep) > 0 && len(c.Label.Drop) > 0 {
+		return fmt.Errorf("label.keep and label.drop are mutually exclusive")
+	}
+	known := stringList(jobInfoLabelNames())
+	for _, labels := range []stringList{c.Label.Keep, c.Label.Drop} {
+		for _, label := range labels {
+			if !known.contains(label) {
+				return fmt.Errorf("unknown label %q in label.keep or label.drop, expected one of %s", label, strings.Join(known, ", "))
+			}
+		}
+	}
+	if c.Label.JobIDRegex != "" {
+		if c.Workload.Manager != "slurm" {
+			return fmt.Errorf("label.job-id-regex requires workload.manager=slurm")
+		}
+		pattern, err := regexp.Compile(c.Label.JobIDRegex)
+		if err != nil {
+			return fmt.Errorf("invalid label.job-id-regex: %v", err)
+		}
+		if pattern.NumSubexp() < 1 {
+			return fmt.Errorf("label.job-id-regex must have a capture group")
+		}
+		c.Label.jobIDPattern = pattern
+	}
+	// Only applied to Slurm, as pod UIDs come from the kubepods hierarchy
+	// and are validated by their cgroup name.
+	if c.Label.JobIDValidRegex != "" && c.Workload.Manager == "slurm" {
+		pattern, err := regexp.Compile(c.Label.JobIDValidRegex)
+		if err != nil {
+			return fmt.Errorf("invalid label.job-id-valid-regex: %v", err)
+		}
+		c.Label.jobIDValidPattern = pattern
+	}
+	if c.Label.JobIDStripArrayTask && c.Workload.Manager != "slurm" {
+		return fmt.Errorf("label.job-id-strip-array-task requires workload.manager=slurm")
+	}
+	c.Label.extra = make(map[string]string, len(c.Label.Extra))
+	for _, label := range c.Label.Extra {
+		name, value, ok := strings.Cut(label, "=")
+		if !ok || !labelNamePattern.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label %q in label.extra, expected name=value", label)
+		}
+		if exporterLabelNames.contains(name) || (c.Slurm.Enrich && known.contains(name)) {
+			return fmt.Errorf("label %q in label.extra is already a label of the exporter's metrics", name)
+		}
+		c.Label.extra[name] = os.ExpandEnv(value)
+	}
+	if c.GPU.TopologyFile != "" {
+		reserved := append(append(stringList(nil), exporterLabelNames...), known...)
+		for name := range c.Label.extra {
+			reserved = append(reserved, name)
+		}
+		topology, err := readGPUTopology(c.GPU.TopologyFile, reserved)
+		if err != nil {
+			return fmt.Errorf("invalid gpu.topology-file: %v", err)
+		}
+		c.GPU.topology = topology
+	}
+	return nil
+}
+
+// parseConfig builds the configuration from the flag defaults, the optional
+// -config.file and the command line args, in increasing order of precedence.
+func parseConfig(fs *flag.FlagSet, args []string) (*Config, error) {
+	cfg := &Config{}
+	cfg.registerFlags(fs)
+	fs.Usage = func() { printUsage(fs) }
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if cfg.ConfigFile != "" {
+		if err := cfg.loadFile(cfg.ConfigFile); err != nil {
+			return nil, err
+		}
+		// Parse the command line again so explicitly set flags override
+		// the values just read from the file.
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestLabelJobID(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		args   []string
+		id     string
+		want   string
+		wantOK bool
+	}{
+		{"default", nil, "1234", "1234", true},
+		{"array task kept", nil, "1234_7", "1234_7", true},
+		{"array task stripped", []string{"-label.job-id-strip-array-task"}, "1234_7", "1234", true},
+		{"strip without array task", []string{"-label.job-id-strip-array-task"}, "1234", "1234", true},
+		{"leading zeros stripped", []string{"-label.job-id-regex=^0*([0-9]+)$"}, "0001234", "1234", true},
+		{"regex not matching", []string{"-label.job-id-regex=^0*([0-9]+)$"}, "1234_7", "1234_7", true},
+		{"strip then regex", []string{"-label.job-id-strip-array-task", "-label.job-id-regex=^0*([0-9]+)$"}, "007_3", "7", true},
+		{"invalid bucketed", nil, "batch", "invalid", true},
+		{"invalid bucketed elsewhere", []string{"-label.invalid-job-id=other"}, "1234.5", "other", true},
+		{"invalid skipped", []string{"-label.invalid-job-id="}, "batch", "", false},
+		{"validation disabled", []string{"-label.job-id-valid-regex="}, "batch", "batch", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := newTestConfig(t, tc.args...)
+			got, ok := cfg.Label.jobID(tc.id)
+			if got != tc.want || ok != tc.wantOK {
+				t.Errorf("jobID(%q) = %q, %v, want %q, %v", tc.id, got, ok, tc.want, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestPrintUsageShowsDefaults(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var c Config
+	c.registerFlags(fs)
+	if err := fs.Parse([]string{"-metrics.max-series=5", "-lint"}); err != nil {
+		t.Fatal(err)
+	}
+	var usage strings.Builder
+	fs.SetOutput(&usage)
+	printUsage(fs)
+
+	if !strings.Contains(usage.String(), "(default 10000)") {
+		t.Errorf("printUsage() doesn't show the default of -metrics.max-series:\n%s", usage.String())
+	}
+	if strings.Contains(usage.String(), "(default 5)") {
+		t.Errorf("printUsage() shows the parsed -metrics.max-series as its default")
+	}
+	if strings.Contains(usage.String(), "-lint") {
+		t.Errorf("printUsage() shows the hidden -lint flag")
+	}
+	if got := fs.Lookup("metrics.max-series").Value.String(); got != "5" {
+		t.Errorf("-metrics.max-series = %s after printUsage, want 5", got)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// totalCounter exposes a running total read from an external source, such as
+// a hardware error counter, as a Prometheus counter. Set adds the increase
+// since the previous reading; a decrease means the source was reset and the
+// new total is added as-is.
+type totalCounter struct {
+	*prometheus.CounterVec
+
+	labelNames []string
+
+	mu   sync.Mutex
+	last map[string]float64
+}
+
+func newTotalCounter(opts prometheus.CounterOpts, labelNames []string) *totalCounter {
+	return &totalCounter{
+		CounterVec: prometheus.NewCounterVec(opts, labelNames),
+		labelNames: labelNames,
+		last:       make(map[string]float64),
+	}
+}
+
+// Set records total as the current reading for the series identified by
+// labels.
+func (c *totalCounter) Set(labels prometheus.Labels, total float64) {
+	key := labelsKey(c.labelNames, labels)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delta := total
+	if last, ok := c.last[key]; ok && total >= last {
+		delta = total - last
+	}
+	c.last[key] = total
+	c.With(labels).Add(delta)
+}
+
+// Delete removes the series identified by labels and forgets its last reading.
+func (c *totalCounter) Delete(labels prometheus.Labels) bool {
+	c.mu.Lock()
+	delete(c.last, labelsKey(c.labelNames, labels))
+	c.mu.Unlock()
+	return c.CounterVec.Delete(labels)
+}
+
+// labelsKey identifies the series of a metric vector with the given label
+// names by its label values.
+func labelsKey(labelNames []string, labels prometheus.Labels) string {
+	values := make([]string, len(labelNames))
+	for i, name := range labelNames {
+		values[i] = labels[name]
+	}
+	return strings.Join(values, "\xff")
+}
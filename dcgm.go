@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// dcgmFields are the DCGM fields sampled by the dcgm backend, in the order
+// passed to dcgmi dmon -e, with the gpuInfo key each is stored under. Fields
+// nvidia-smi also reports reuse its --query-gpu name; profiling fields have
+// no nvidia-smi equivalent and keep their DCGM name.
+var dcgmFields = []struct {
+	id    int
+	field string
+}{
+	{203, "utilization.gpu"},
+	{204, "utilization.memory"},
+	{206, "utilization.encoder"},
+	{207, "utilization.decoder"},
+	{1002, "DCGM_FI_PROF_SM_ACTIVE"},
+	{1004, "DCGM_FI_PROF_PIPE_TENSOR_ACTIVE"},
+	{1005, "DCGM_FI_PROF_DRAM_ACTIVE"},
+	{90, "DCGM_FI_DEV_BAR1_TOTAL"},
+	{91, "DCGM_FI_DEV_BAR1_USED"},
+}
+
+// newGPUProfilingMetrics returns the metrics exposing the DCGM profiling
+// fields, keyed by field.
+func newGPUProfilingMetrics() map[string]*prometheus.GaugeVec {
+	return map[string]*prometheus.GaugeVec{
+		"DCGM_FI_PROF_SM_ACTIVE": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gpu_sm_active_ratio",
+			Help: "Fraction of time at least one warp was active on an SM, averaged over all SMs (DCGM backend only).",
+		}, []string{"gpu_id"}),
+
+		"DCGM_FI_PROF_PIPE_TENSOR_ACTIVE": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gpu_tensor_active_ratio",
+			Help: "Fraction of cycles the tensor cores were active (DCGM backend only).",
+		}, []string{"gpu_id"}),
+
+		"DCGM_FI_PROF_DRAM_ACTIVE": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gpu_dram_active_ratio",
+			Help: "Fraction of cycles the device memory interface was active (DCGM backend only).",
+		}, []string{"gpu_id"}),
+	}
+}
+
+// newGPUBAR1Metrics returns the metrics exposing the BAR1 memory fields,
+// which DCGM reports in MiB, keyed by field. nvidia-smi only prints BAR1
+// usage in its human-readable -q output, so they need the dcgm backend.
+func newGPUBAR1Metrics() map[string]*prometheus.GaugeVec {
+	return map[string]*prometheus.GaugeVec{
+		"DCGM_FI_DEV_BAR1_TOTAL": prometheus.NewGaugeVec(memoryGaugeOpts(prometheus.GaugeOpts{
+			Name: "gpu_bar1_memory_total_bytes",
+			Help: "Size of the GPU's BAR1 aperture, through which peers and GPUDirect devices access its memory, in bytes (DCGM backend only).",
+		}), []string{"gpu_id"}),
+
+		"DCGM_FI_DEV_BAR1_USED": prometheus.NewGaugeVec(memoryGaugeOpts(prometheus.GaugeOpts{
+			Name: "gpu_bar1_memory_used_bytes",
+			Help: "Memory of the GPU's BAR1 aperture that is mapped in bytes (DCGM backend only).",
+		}), []string{"gpu_id"}),
+	}
+}
+
+// newDCGMSource returns a source backed by `dcgmi dmon`, which requires a
+// running nv-hostengine, the local one unless host is set. dcgmi subscribes
+// to the fields on the hostengine, so NVML is only initialized there. The
+// dcgmi tool is run rather than the DCGM library linked through go-dcgm,
+// which needs cgo and libdcgm at build time, so that the binary runs on
+// nodes without DCGM. Besides utilization it provides the profiling and BAR1
+// metrics nvidia-smi can't report; ECC errors, fan speed and modes are not
+// available from it.
+func newDCGMSource(host string) *streamSource {
+	return &streamSource{
+		name: "dcgmi dmon",
+		stream: func(ctx context.Context, record func(gpuInfo)) error {
+			return streamDCGM(ctx, host, record)
+		},
+		clock:   realClock{},
+		samples: make(map[string]gpuInfo),
+	}
+}
+
+// streamDCGM runs a single dcgmi dmon process, connected to the hostengine
+// at host if set, and records its samples until it exits.
+func streamDCGM(ctx context.Context, host string, record func(gpuInfo)) error {
+	uuids, err := queryGPUUUIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, len(dcgmFields))
+	for i, f := range dcgmFields {
+		ids[i] = strconv.Itoa(f.id)
+	}
+	args := []string{"dmon", "-e", strings.Join(ids, ",")}
+	if host != "" {
+		// dcgmi takes the socket of a hostengine started with -d as
+		// unix://<path>.
+		args = append(args, "--host", host)
+	}
+	cmd := exec.CommandContext(ctx, "dcgmi", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		// Sample lines look like "GPU 0  45  12  0.512  0.003  0.210", with
+		// the values in -e order. Header lines start with "#Entity" or "ID".
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2+len(dcgmFields) || fields[0] != "GPU" {
+			continue
+		}
+
+		index := fields[1]
+		gpu := gpuInfo{"index": index, "gpu_uuid": uuids[index]}
+		for i, f := range dcgmFields {
+			// dcgmi prints N/A for fields the GPU doesn't support, e.g.
+			// profiling fields on pre-Volta GPUs.
+			if value := fields[2+i]; value != "N/A" {
+				gpu[f.field] = value
+			}
+		}
+		record(gpu)
+	}
+
+	err = cmd.Wait()
+	if err == nil {
+		err = errors.New("process exited")
+	}
+	return err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// errorLogSize is the number of recent collection errors kept for
+// /debug/errors.
+const errorLogSize = 100
+
+// debugJob is the JSON representation of a job in /debug/jobs.
+type debugJob struct {
+	ID   string   `json:"id"`
+	UID  string   `json:"uid,omitempty"`
+	PIDs []string `json:"pids"`
+	GPUs []string `json:"gpus"`
+}
+
+// jobSnapshot holds the jobs found by the last GPU collection cycle and the
+// GPUs it attributed to each, and serves them as JSON for debugging
+// attribution. A nil *jobSnapshot ignores updates.
+type jobSnapshot struct {
+	mu   sync.Mutex
+	jobs []debugJob
+}
+
+// update replaces the snapshot with jobs, and jobGPUs the indexes of the GPUs
+// each job ID uses or is allocated.
+func (s *jobSnapshot) update(jobs []slurmJob, jobGPUs map[string]map[string]struct{}) {
+	if s == nil {
+		return
+	}
+
+	snapshot := make([]debugJob, 0, len(jobs))
+	for _, job := range jobs {
+		gpus := make([]string, 0, len(jobGPUs[job.ID]))
+		for index := range jobGPUs[job.ID] {
+			gpus = append(gpus, index)
+		}
+		sort.Strings(gpus)
+		snapshot = append(snapshot, debugJob{ID: job.ID, UID: job.UID, PIDs: job.PIDs, GPUs: gpus})
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].ID < snapshot[j].ID })
+
+	s.mu.Lock()
+	s.jobs = snapshot
+	s.mu.Unlock()
+}
+
+// ServeHTTP implements http.Handler.
+func (s *jobSnapshot) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	jobs := s.jobs
+	s.mu.Unlock()
+
+	if jobs == nil {
+		jobs = []debugJob{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
+
+// debugError is the JSON representation of a collection error in
+// /debug/errors.
+type debugError struct {
+	Time      time.Time `json:"time"`
+	Collector string    `json:"collector"`
+	Error     string    `json:"error"`
+}
+
+// errorLog keeps the last errorLogSize collection errors in a ring buffer and
+// serves them as JSON, oldest first, so that they can be looked at without
+// the logs. A nil *errorLog ignores errors.
+type errorLog struct {
+	mu     sync.Mutex
+	errors []debugError
+	// next is the index of the oldest error once the buffer is full.
+	next int
+}
+
+// add records err of collector at t, replacing the oldest error if the
+// buffer is full.
+func (l *errorLog) add(t time.Time, collector string, err string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry := debugError{Time: t, Collector: collector, Error: err}
+	if len(l.errors) < errorLogSize {
+		l.errors = append(l.errors, entry)
+		return
+	}
+	l.errors[l.next] = entry
+	l.next = (l.next + 1) % errorLogSize
+}
+
+// ServeHTTP implements http.Handler.
+func (l *errorLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.mu.Lock()
+	errors := make([]debugError, 0, len(l.errors))
+	errors = append(errors, l.errors[l.next:]...)
+	errors = append(errors, l.errors[:l.next]...)
+	l.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(errors)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricNames are the metrics the exporter can expose besides the
+// gpuGaugeFields, which -metrics.disable accepts. Metrics added to the
+// exporter need to be listed here to be disabled.
+var metricNames = stringList{
+	"gpu_utilization",
+	"gpu_memory_usage_bytes",
+	"gpu_ecc_errors_total",
+	"gpu_compute_mode",
+	"gpu_persistence_mode",
+	"gpu_process_count",
+	"gpu_present",
+	"gpu_query_success",
+	"gpu_sm_active_ratio",
+	"gpu_tensor_active_ratio",
+	"gpu_dram_active_ratio",
+	"gpu_bar1_memory_total_bytes",
+	"gpu_bar1_memory_used_bytes",
+	"gpu_throttle_seconds_total",
+	"gpu_driver_info",
+	"node_gpu_count",
+	"node_gpu_utilization_avg",
+	"node_gpu_memory_used_bytes",
+	"node_io_read_bytes_total",
+	"node_io_write_bytes_total",
+	"job_gpu_utilization_percent",
+	"job_gpu_memory_usage_bytes",
+	"job_gpu_memory_max_bytes",
+	"job_gpu_count",
+	"job_gpu_seconds_total",
+	"job_gpu_allocated_index",
+	"job_gpu_allocated",
+	"job_gpu_avg_utilization_percent",
+	"job_gpu_max_memory_bytes",
+	"job_process_count",
+	"job_thread_count",
+	"job_state",
+	"job_info",
+	"job_runtime_seconds",
+	"job_memory_oom_kills_total",
+	"job_network_rx_bytes_total",
+	"job_network_tx_bytes_total",
+	"io_read_bytes_total",
+	"io_write_bytes_total",
+	"io_read_bytes",
+	"io_write_bytes",
+	"job_proc_io_read_bytes",
+	"job_proc_io_write_bytes",
+	"job_io_read_bytes_total",
+	"job_io_write_bytes_total",
+	"job_io_read_bytes_per_second",
+	"job_io_write_bytes_per_second",
+	"job_scratch_bytes",
+	"job_exporter_collection_errors_total",
+	"job_exporter_last_collection_timestamp_seconds",
+	"job_exporter_dropped_series_total",
+	"job_exporter_unmatched_gpu_total",
+	"job_exporter_pid_attribution_failures_total",
+	"job_exporter_cgroup_walk_seconds",
+	"job_exporter_ready",
+	"job_exporter_io_permission_denied_total",
+	"job_exporter_io_source",
+	"job_exporter_clock_anomalies_total",
+}
+
+// knownMetricName reports whether name is a metric the exporter can expose,
+// under the name of either -metrics.memory-unit.
+func knownMetricName(name string) bool {
+	if mib, ok := strings.CutSuffix(name, "_mebibytes"); ok {
+		name = mib + "_bytes"
+	}
+	if metricNames.contains(name) {
+		return true
+	}
+	for _, field := range gpuGaugeFields {
+		if field.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// disablingRegisterer skips the registration of the collectors of metrics
+// disabled with -metrics.disable, so that they are never exposed. Collectors
+// of several metrics are only skipped if all of them are disabled.
+type disablingRegisterer struct {
+	prometheus.Registerer
+	disabled stringList
+}
+
+// newDisablingRegisterer returns reg itself when no metric is disabled.
+func newDisablingRegisterer(reg prometheus.Registerer, disabled stringList) prometheus.Registerer {
+	if len(disabled) == 0 {
+		return reg
+	}
+	return &disablingRegisterer{Registerer: reg, disabled: disabled}
+}
+
+func (r *disablingRegisterer) Register(c prometheus.Collector) error {
+	if r.isDisabled(c) {
+		return nil
+	}
+	return r.Registerer.Register(c)
+}
+
+func (r *disablingRegisterer) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (r *disablingRegisterer) Unregister(c prometheus.Collector) bool {
+	if r.isDisabled(c) {
+		return false
+	}
+	return r.Registerer.Unregister(c)
+}
+
+// isDisabled reports whether every metric c describes is disabled.
+func (r *disablingRegisterer) isDisabled(c prometheus.Collector) bool {
+	names := collectorNames(c)
+	for _, name := range names {
+		if !r.disabled.contains(name) {
+			return false
+		}
+	}
+	return len(names) > 0
+}
+
+// collectorNames returns the names of the metrics c describes.
+func collectorNames(c prometheus.Collector) stringList {
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		c.Describe(descs)
+		close(descs)
+	}()
+	var names stringList
+	for desc := range descs {
+		names = append(names, descName(desc))
+	}
+	return names
+}
+
+// descName returns the name of the metric desc describes. client_golang
+// only exposes it through String, which starts with the quoted name.
+func descName(desc *prometheus.Desc) string {
+	rest, ok := strings.CutPrefix(desc.String(), "Desc{fqName: ")
+	if !ok {
+		return ""
+	}
+	quoted, err := strconv.QuotedPrefix(rest)
+	if err != nil {
+		return ""
+	}
+	name, _ := strconv.Unquote(quoted)
+	return name
+}
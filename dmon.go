@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// dmonRestartDelay is how long to wait before restarting an exited
+	// sampling process.
+	dmonRestartDelay = 5 * time.Second
+
+	// dmonStaleAfter is how old the latest sample of a streaming source may
+	// get before it is no longer reported, e.g. because the process hung.
+	dmonStaleAfter = 10 * time.Second
+)
+
+// dmonColumns maps the nvidia-smi dmon -s u column names to the --query-gpu
+// field they correspond to.
+var dmonColumns = map[string]string{
+	"sm":  "utilization.gpu",
+	"mem": "utilization.memory",
+	"enc": "utilization.encoder",
+	"dec": "utilization.decoder",
+}
+
+// streamSource keeps a long-lived sampling process running and serves the
+// latest sample of every GPU, so collection cycles don't spawn a process for
+// device-level state. stream runs the process once, passing each sample to
+// record, and returns when it exits.
+type streamSource struct {
+	name   string
+	stream func(ctx context.Context, record func(gpuInfo)) error
+	clock  clock
+
+	mu      sync.Mutex
+	samples map[string]gpuInfo // keyed by GPU index
+	updated time.Time
+}
+
+// newDmonSource returns a source backed by `nvidia-smi dmon`. dmon only
+// reports utilization, so fields such as ECC errors and fan speed are not
+// available from it.
+func newDmonSource() *streamSource {
+	return &streamSource{
+		name:    "nvidia-smi dmon",
+		stream:  streamDmon,
+		clock:   realClock{},
+		samples: make(map[string]gpuInfo),
+	}
+}
+
+func (s *streamSource) queryGPUs(ctx context.Context) ([]gpuInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.samples) == 0 {
+		return nil, fmt.Errorf("no %s samples received yet", s.name)
+	}
+	if s.clock.Now().Sub(s.updated) > dmonStaleAfter {
+		return nil, fmt.Errorf("last %s sample is older than %s", s.name, dmonStaleAfter)
+	}
+
+	gpus := make([]gpuInfo, 0, len(s.samples))
+	for _, gpu := range s.samples {
+		gpus = append(gpus, gpu)
+	}
+	return gpus, nil
+}
+
+// run keeps the sampling process running, restarting it whenever it exits,
+// until ctx is cancelled.
+func (s *streamSource) run(ctx context.Context) {
+	for {
+		err := s.stream(ctx, s.record)
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Printf("WARN: %s stopped, restarting in %s: %s\n", s.name, dmonRestartDelay, err)
+
+		s.mu.Lock()
+		s.samples = make(map[string]gpuInfo)
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.clock.After(dmonRestartDelay):
+		}
+	}
+}
+
+func (s *streamSource) record(gpu gpuInfo) {
+	s.mu.Lock()
+	s.samples[gpu["index"]] = gpu
+	s.updated = s.clock.Now()
+	s.mu.Unlock()
+}
+
+// queryGPUUUIDs maps the index of every GPU to its UUID, for sources that
+// identify GPUs by index only. The UUIDs let compute apps be matched to
+// devices.
+func queryGPUUUIDs(ctx context.Context) (map[string]string, error) {
+	output, err := nvidiaSMI(ctx, "--query-gpu=index,gpu_uuid", "--format=csv,noheader").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query GPU UUIDs: %v", err)
+	}
+	uuids := make(map[string]string)
+	for _, gpu := range parseGPUQuery(output, []string{"index", "gpu_uuid"}) {
+		uuids[gpu["index"]] = gpu["gpu_uuid"]
+	}
+	return uuids, nil
+}
+
+// streamDmon runs a single nvidia-smi dmon process and records its samples
+// until it exits.
+func streamDmon(ctx context.Context, record func(gpuInfo)) error {
+	// dmon identifies GPUs by index only, so look up their UUIDs once per
+	// process.
+	uuids, err := queryGPUUUIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	cmd := nvidiaSMI(ctx, "dmon", "-s", "u")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	var columns []string
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		// The header is repeated periodically: a "# gpu sm mem ..." line
+		// naming the columns, followed by a "# Idx % % ..." units line.
+		if fields[0] == "#" {
+			if len(fields) > 1 && fields[1] == "gpu" {
+				columns = fields[1:]
+			}
+			continue
+		}
+		if len(fields) != len(columns) {
+			continue
+		}
+
+		gpu := gpuInfo{"index": fields[0], "gpu_uuid": uuids[fields[0]]}
+		for i, column := range columns {
+			// dmon prints "-" for values the GPU doesn't support.
+			if field, ok := dmonColumns[column]; ok && fields[i] != "-" {
+				gpu[field] = fields[i]
+			}
+		}
+
+		record(gpu)
+	}
+
+	err = cmd.Wait()
+	if err == nil {
+		err = errors.New("process exited")
+	}
+	return err
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// cudaVersionPattern matches the CUDA version in the header of nvidia-smi's
+// default output, e.g. "| NVIDIA-SMI 550.54.15  Driver Version: 550.54.15
+// CUDA Version: 12.4 |". No --query-gpu field reports it.
+var cudaVersionPattern = regexp.MustCompile(`CUDA Version:\s*([0-9.]+)`)
+
+// gpuDriverInfo exposes the node's NVIDIA driver and the CUDA version it
+// supports, e.g. to follow a driver rollout across the fleet. They only
+// change when the driver is reloaded, which resets the GPUs and in practice
+// the exporter with them, so they are read until the first success only.
+type gpuDriverInfo struct {
+	info *prometheus.GaugeVec
+	read bool
+}
+
+// newGPUDriverInfo creates the driver info metric and registers it with reg.
+func newGPUDriverInfo(reg prometheus.Registerer) *gpuDriverInfo {
+	d := &gpuDriverInfo{
+		info: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gpu_driver_info",
+			Help: "Always 1, labeled with the NVIDIA driver version and the CUDA version it supports, from nvidia-smi.",
+		}, []string{"driver_version", "cuda_version"}),
+	}
+	register(reg, d.info)
+	return d
+}
+
+// collect reads the versions and sets read once it succeeds.
+func (d *gpuDriverInfo) collect(ctx context.Context) error {
+	output, err := nvidiaSMI(ctx, "--query-gpu=driver_version", "--format=csv,noheader").Output()
+	if err != nil {
+		return fmt.Errorf("failed to query the driver version: %v", err)
+	}
+	header, err := nvidiaSMI(ctx).Output()
+	if err != nil {
+		return fmt.Errorf("failed to read the CUDA version: %v", err)
+	}
+	cudaVersion := ""
+	if match := cudaVersionPattern.FindSubmatch(header); match != nil {
+		cudaVersion = string(match[1])
+	}
+
+	// All GPUs of a node share the driver, but a series per distinct
+	// version costs nothing should that ever not hold.
+	for _, gpu := range parseGPUQuery(output, []string{"driver_version"}) {
+		if version := strings.TrimSpace(gpu["driver_version"]); version != "" {
+			d.info.WithLabelValues(version, cudaVersion).Set(1)
+		}
+	}
+	d.read = true
+	return nil
+}
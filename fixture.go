@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// fixtureSource reads the device-level GPU state from a file of canned
+// nvidia-smi --query-gpu output, as recorded with
+//
+//	nvidia-smi --query-gpu=<fields> --format=csv,nounits > gpus.csv
+//
+// so that the exporter can run with realistic data on machines without
+// GPUs, e.g. in CI. The header names the fields, and the file is read every
+// cycle, so it can be edited while the exporter runs.
+type fixtureSource struct {
+	path string
+}
+
+func newFixtureSource(path string) *fixtureSource {
+	return &fixtureSource{path: path}
+}
+
+func (s *fixtureSource) queryGPUs(ctx context.Context) ([]gpuInfo, error) {
+	content, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	header, rows, _ := strings.Cut(strings.TrimSpace(string(content)), "\n")
+	var fields []string
+	for _, column := range strings.Split(header, ",") {
+		// Columns are named e.g. "memory.used [MiB]".
+		field, _, _ := strings.Cut(strings.TrimSpace(column), " [")
+		fields = append(fields, field)
+	}
+	for _, field := range gpuRequiredQueryFields {
+		if !stringList(fields).contains(field) {
+			return nil, fmt.Errorf("%s: no %s column in the header", s.path, field)
+		}
+	}
+	return parseGPUQuery([]byte(rows), fields), nil
+}
+
+// queryComputeApps returns the compute apps of every GPU as nvidia-smi
+// --query-compute-apps=pid,used_gpu_memory,gpu_uuid --format=csv,noheader
+// lists them, from -gpu.apps-fixture-file if set. With -gpu.fixture-file
+// alone there are none, as there is no nvidia-smi to ask.
+func queryComputeApps(ctx context.Context, cfg GPUConfig) ([]byte, error) {
+	switch {
+	case cfg.AppsFixtureFile != "":
+		return os.ReadFile(cfg.AppsFixtureFile)
+	case cfg.FixtureFile != "":
+		return nil, nil
+	}
+	output, err := nvidiaSMI(ctx, "--query-compute-apps=pid,used_gpu_memory,gpu_uuid", "--format=csv,noheader").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute command: %v", err)
+	}
+	return output, nil
+}
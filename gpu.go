@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gpuRequiredQueryFields are the nvidia-smi --query-gpu fields every
+// collection cycle needs, which are queried regardless of -gpu.query.
+var gpuRequiredQueryFields = []string{"gpu_uuid", "index", "utilization.gpu"}
+
+// gpuDefaultQueryFields are the fields -gpu.query selects by default.
+var gpuDefaultQueryFields = []string{
+	"ecc.errors.corrected.aggregate.total",
+	"ecc.errors.uncorrected.aggregate.total",
+	"fan.speed",
+	"utilization.memory",
+	"utilization.encoder",
+	"utilization.decoder",
+	"compute_mode",
+	"persistence_mode",
+	"memory.total",
+	"memory.used",
+	"memory.free",
+	"memory.reserved",
+}
+
+// gpuOptionalQueryFields are the fields that older drivers reject as invalid,
+// failing the whole query. They are left out if that happens.
+var gpuOptionalQueryFields = []string{"memory.reserved"}
+
+// gpuGaugeField is the per-GPU gauge exposing an nvidia-smi field, and how
+// its value is converted to the metric's unit.
+type gpuGaugeField struct {
+	name  string
+	help  string
+	parse func(string) (float64, error)
+}
+
+// gpuGaugeFields maps the fields that are exposed as a plain per-GPU gauge to
+// their metric. Adding a field here makes it selectable with -gpu.query.
+// memory.total is the sum of memory.used, memory.free and memory.reserved.
+var gpuGaugeFields = map[string]gpuGaugeField{
+	"fan.speed":           {"gpu_fan_speed_percent", "GPU fan speed as a percentage of its maximum.", parsePercent},
+	"utilization.memory":  {"gpu_memory_utilization_percent", "Percentage of time the GPU memory controller was busy.", parsePercent},
+	"utilization.encoder": {"gpu_encoder_utilization_percent", "Percentage of time the GPU video encoder (NVENC) was busy.", parsePercent},
+	"utilization.decoder": {"gpu_decoder_utilization_percent", "Percentage of time the GPU video decoder (NVDEC) was busy.", parsePercent},
+	"memory.total":        {"gpu_memory_total_bytes", "Total GPU memory in bytes.", parseMiB},
+	"memory.used":         {"gpu_memory_used_bytes", "GPU memory allocated by processes in bytes.", parseMiB},
+	"memory.free":         {"gpu_memory_free_bytes", "Free GPU memory in bytes.", parseMiB},
+	"memory.reserved":     {"gpu_memory_reserved_bytes", "GPU memory reserved by the driver and firmware in bytes. Not reported by older drivers.", parseMiB},
+	"temperature.gpu":     {"gpu_temperature_celsius", "GPU core temperature in degrees Celsius.", parseFloat},
+	"power.draw":          {"gpu_power_draw_watts", "GPU power draw in watts.", parseFloat},
+	"clocks.sm":           {"gpu_sm_clock_hertz", "Current SM clock in hertz.", parseMHz},
+	"clocks.mem":          {"gpu_memory_clock_hertz", "Current memory clock in hertz.", parseMHz},
+}
+
+// knownGPUQueryField reports whether field can be selected with -gpu.query,
+// i.e. whether the exporter knows which metric to expose it as.
+func knownGPUQueryField(field string) bool {
+	if _, ok := gpuGaugeFields[field]; ok {
+		return true
+	}
+	for _, eccField := range gpuEccFields {
+		if field == eccField {
+			return true
+		}
+	}
+	return field == "compute_mode" || field == "persistence_mode" || field == gpuThrottleField || stringList(gpuRequiredQueryFields).contains(field)
+}
+
+// gpuQueryFields returns the fields to query for the selected ones: the
+// required fields followed by the selected fields, without duplicates.
+func gpuQueryFields(selected []string) []string {
+	fields := append([]string(nil), gpuRequiredQueryFields...)
+	for _, field := range selected {
+		if !stringList(fields).contains(field) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// gpuEccFields maps the type label of gpu_ecc_errors_total to its nvidia-smi
+// field.
+var gpuEccFields = map[string]string{
+	"corrected":   "ecc.errors.corrected.aggregate.total",
+	"uncorrected": "ecc.errors.uncorrected.aggregate.total",
+}
+
+// gpuInfo holds the device-level state of one GPU, keyed by nvidia-smi
+// --query-gpu field name, or DCGM field name for fields nvidia-smi doesn't
+// report. Every source provides at least gpu_uuid and index; other fields may
+// be missing or [N/A].
+type gpuInfo map[string]string
+
+// gpuSource provides the device-level part of a GPU collection cycle.
+type gpuSource interface {
+	queryGPUs(ctx context.Context) ([]gpuInfo, error)
+}
+
+// smiQuerySource runs nvidia-smi --query-gpu once per collection cycle.
+type smiQuerySource struct {
+	fields []string
+}
+
+func newSMIQuerySource(fields []string) *smiQuerySource {
+	return &smiQuerySource{fields: fields}
+}
+
+func (s *smiQuerySource) queryGPUs(ctx context.Context) ([]gpuInfo, error) {
+	output, err := runGPUQuery(ctx, s.fields)
+	if err != nil && ctx.Err() == nil {
+		// Retry without the optional fields, and stop asking for them if
+		// that works.
+		var supported []string
+		for _, field := range s.fields {
+			if !stringList(gpuOptionalQueryFields).contains(field) {
+				supported = append(supported, field)
+			}
+		}
+		if len(supported) < len(s.fields) {
+			if output, retryErr := runGPUQuery(ctx, supported); retryErr == nil {
+				fmt.Printf("WARN: nvidia-smi doesn't support %s, omitting it: %v\n", strings.Join(gpuOptionalQueryFields, ", "), err)
+				s.fields = supported
+				return parseGPUQuery(output, s.fields), nil
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseGPUQuery(output, s.fields), nil
+}
+
+// warnUnknownExcludedGPUs warns about the -gpu.exclude identifiers that are
+// neither the index nor the UUID of a GPU of the node, e.g. typos.
+func warnUnknownExcludedGPUs(ctx context.Context, exclude stringList) {
+	uuids, err := queryGPUUUIDs(ctx)
+	if err != nil {
+		fmt.Printf("WARN: Failed to list the GPUs to check gpu.exclude: %v\n", err)
+		return
+	}
+	known := make(stringList, 0, 2*len(uuids))
+	for index, uuid := range uuids {
+		known = append(known, index, uuid)
+	}
+	for _, id := range exclude {
+		if !known.contains(id) {
+			fmt.Printf("WARN: GPU %s in gpu.exclude doesn't exist\n", id)
+		}
+	}
+}
+
+// nvidiaSMI returns a command running nvidia-smi with args in the C locale,
+// so that its numbers have a dot as decimal separator and no thousands
+// separator whatever the node's locale, as the parse functions below expect.
+func nvidiaSMI(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "nvidia-smi", args...)
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	return cmd
+}
+
+func runGPUQuery(ctx context.Context, fields []string) ([]byte, error) {
+	return nvidiaSMI(ctx, "--query-gpu="+strings.Join(fields, ","), "--format=csv,noheader,nounits").Output()
+}
+
+func parseFloat(value string) (float64, error) {
+	return strconv.ParseFloat(value, 64)
+}
+
+// parsePercent parses a nvidia-smi percentage, with or without the unit:
+// "45 %" with --format=csv, as in fixtures recorded without nounits, "45"
+// with nounits.
+func parsePercent(value string) (float64, error) {
+	return strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "%")), 64)
+}
+
+// parseMHz converts a nvidia-smi clock value in MHz, without the unit, to
+// hertz.
+func parseMHz(value string) (float64, error) {
+	mhz, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	return mhz * 1e6, nil
+}
+
+// memoryInMiB is set by -metrics.memory-unit=mib.
+var memoryInMiB bool
+
+// parseMiB converts a nvidia-smi memory value in MiB, with or without the
+// unit, to bytes: "1024 MiB" with --format=csv, "1024" with nounits. With
+// -metrics.memory-unit=mib, the value is kept in MiB. nvidia-smi reports all
+// memory in whole MiB, so every memory metric goes through it and byte values
+// are multiples of 1048576.
+func parseMiB(value string) (float64, error) {
+	mib, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), " MiB"), 64)
+	if err != nil {
+		return 0, err
+	}
+	if memoryInMiB {
+		return mib, nil
+	}
+	return mib * 1024 * 1024, nil
+}
+
+// memoryGaugeOpts returns the options of a gauge named and documented in
+// bytes in the unit parseMiB converts to: with -metrics.memory-unit=mib, the
+// _bytes suffix becomes _mebibytes and "in bytes" in the help "in MiB". Other
+// gauges are returned unchanged.
+func memoryGaugeOpts(opts prometheus.GaugeOpts) prometheus.GaugeOpts {
+	if memoryInMiB && strings.HasSuffix(opts.Name, "_bytes") {
+		opts.Name = strings.TrimSuffix(opts.Name, "_bytes") + "_mebibytes"
+		opts.Help = strings.Replace(opts.Help, " in bytes", " in MiB", 1)
+	}
+	return opts
+}
+
+// parseGPUQuery maps each CSV line of nvidia-smi --query-gpu output to the
+// given fields. Lines with an unexpected number of columns are skipped.
+func parseGPUQuery(output []byte, fields []string) []gpuInfo {
+	var gpus []gpuInfo
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		parts := strings.Split(line, ",")
+		// Tolerate a trailing comma.
+		if len(parts) == len(fields)+1 && strings.TrimSpace(parts[len(fields)]) == "" {
+			parts = parts[:len(fields)]
+		}
+		if len(parts) != len(fields) {
+			continue
+		}
+		gpu := make(gpuInfo, len(parts))
+		for i, field := range fields {
+			gpu[field] = strings.TrimSpace(parts[i])
+		}
+		gpus = append(gpus, gpu)
+	}
+	return gpus
+}
+
+// validGPUs returns the GPUs whose index is a non-negative integer, with the
+// index normalized, e.g. " 01" to "1", as it is used as the gpu_id label and
+// to match GPUs across sources. Other GPUs are logged and left out. The
+// gpuInfo of streaming sources is shared with their samples, so it is copied
+// rather than modified.
+func validGPUs(gpus []gpuInfo) []gpuInfo {
+	valid := make([]gpuInfo, 0, len(gpus))
+	for _, gpu := range gpus {
+		index, err := strconv.ParseUint(strings.TrimSpace(gpu["index"]), 10, 32)
+		if err != nil {
+			fmt.Printf("WARN: Skipping GPU %s with malformed index %q\n", gpu["gpu_uuid"], gpu["index"])
+			continue
+		}
+		if normalized := strconv.FormatUint(index, 10); normalized != gpu["index"] {
+			normalizedGPU := make(gpuInfo, len(gpu))
+			for field, value := range gpu {
+				normalizedGPU[field] = value
+			}
+			normalizedGPU["index"] = normalized
+			gpu = normalizedGPU
+		}
+		valid = append(valid, gpu)
+	}
+	return valid
+}
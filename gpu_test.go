@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseMiB(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  float64
+	}{
+		// --format=csv
+		{"100 MiB", 104857600},
+		// --format=csv,nounits
+		{"100", 104857600},
+		{" 1024 MiB ", 1073741824},
+		{"0 MiB", 0},
+	} {
+		got, err := parseMiB(tc.value)
+		if err != nil || got != tc.want {
+			t.Errorf("parseMiB(%q) = %v, %v, want %v", tc.value, got, err, tc.want)
+		}
+	}
+	for _, value := range []string{"[N/A]", "", "100 GiB"} {
+		if got, err := parseMiB(value); err == nil {
+			t.Errorf("parseMiB(%q) = %v, want an error", value, got)
+		}
+	}
+}
+
+func TestParseMiBMemoryUnitMiB(t *testing.T) {
+	memoryInMiB = true
+	t.Cleanup(func() { memoryInMiB = false })
+	if got, err := parseMiB("100 MiB"); err != nil || got != 100 {
+		t.Errorf("parseMiB(\"100 MiB\") with -metrics.memory-unit=mib = %v, %v, want 100", got, err)
+	}
+}
+
+func TestParsePercent(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  float64
+	}{
+		// --format=csv
+		{"45 %", 45},
+		// --format=csv,nounits
+		{"45", 45},
+		{"45%", 45},
+		{" 100 % ", 100},
+		{"0 %", 0},
+	} {
+		got, err := parsePercent(tc.value)
+		if err != nil || got != tc.want {
+			t.Errorf("parsePercent(%q) = %v, %v, want %v", tc.value, got, err, tc.want)
+		}
+	}
+	for _, value := range []string{"[N/A]", "", "%"} {
+		if got, err := parsePercent(value); err == nil {
+			t.Errorf("parsePercent(%q) = %v, want an error", value, got)
+		}
+	}
+}
+
+func TestNvidiaSMIRunsInCLocale(t *testing.T) {
+	t.Setenv("LC_ALL", "de_DE.UTF-8")
+	cmd := nvidiaSMI(context.Background(), "--query-compute-apps=pid,used_gpu_memory,gpu_uuid", "--format=csv,noheader")
+	var lcAll []string
+	for _, variable := range cmd.Environ() {
+		if name, value, _ := strings.Cut(variable, "="); name == "LC_ALL" {
+			lcAll = append(lcAll, value)
+		}
+	}
+	if len(lcAll) != 1 || lcAll[0] != "C" {
+		t.Errorf("nvidia-smi runs with LC_ALL=%q, want C", lcAll)
+	}
+}
+
+// TestComputeAppsCanonicalFormat documents the compute app lines the C
+// locale gives, which the GPU cycle parses: the memory is a whole number of
+// MiB without separators, followed by " MiB".
+func TestComputeAppsCanonicalFormat(t *testing.T) {
+	line := "12345, 1024 MiB, GPU-6f1a2b3c-0d4e-5f60-7182-93a4b5c6d7e8"
+	parts := strings.Split(line, ", ")
+	if len(parts) != 3 {
+		t.Fatalf("%q has %d fields, want 3", line, len(parts))
+	}
+	if memory, err := parseMiB(parts[1]); err != nil || memory != 1024*1024*1024 {
+		t.Errorf("parseMiB(%q) = %v, %v, want 1073741824", parts[1], memory, err)
+	}
+
+	// What other locales would print, which the C locale rules out.
+	for _, value := range []string{"1,024 MiB", "1 024 MiB", "1.024,5 MiB"} {
+		if _, err := parseMiB(value); err == nil {
+			t.Errorf("parseMiB(%q) succeeded, the format must be the C locale's", value)
+		}
+	}
+}
+
+func TestParseGPUQueryMalformedLines(t *testing.T) {
+	fields := []string{"gpu_uuid", "index", "utilization.gpu"}
+	output := "GPU-a, 0, 10\n" +
+		// A trailing comma and stray spaces.
+		"GPU-b ,  1 , 20,\n" +
+		"GPU-c, 02, 30 , \n" +
+		// An extra field, a missing one and a malformed index.
+		"GPU-d, 3, 40, 50\n" +
+		"GPU-e, 4\n" +
+		"GPU-f, x, 60\n" +
+		"GPU-g, -1, 70\n"
+
+	gpus := validGPUs(parseGPUQuery([]byte(output), fields))
+	want := []struct{ uuid, index, utilization string }{
+		{"GPU-a", "0", "10"},
+		{"GPU-b", "1", "20"},
+		{"GPU-c", "2", "30"},
+	}
+	if len(gpus) != len(want) {
+		t.Fatalf("parsed %d GPUs, want %d: %v", len(gpus), len(want), gpus)
+	}
+	for i, w := range want {
+		gpu := gpus[i]
+		if gpu["gpu_uuid"] != w.uuid || gpu["index"] != w.index || gpu["utilization.gpu"] != w.utilization {
+			t.Errorf("GPU %d = %v, want uuid %s, index %s, utilization %s", i, gpu, w.uuid, w.index, w.utilization)
+		}
+	}
+}
+
+func TestFixtureWithUnits(t *testing.T) {
+	newTestRootfs(t, map[string]string{
+		testJobDir + "/cgroup.procs": "100\n",
+	})
+	fixtures := t.TempDir()
+	gpus := filepath.Join(fixtures, "gpus.csv")
+	apps := filepath.Join(fixtures, "apps.csv")
+	// Recorded with --format=csv rather than --format=csv,nounits.
+	writeTestFile(t, gpus, "index, gpu_uuid, utilization.gpu [%], utilization.memory [%], fan.speed [%], memory.used [MiB]\n"+
+		"0, GPU-a, 45 %, 12 %, 30 %, 1024 MiB\n"+
+		"1, GPU-b, 100 %, 0 %, [N/A], 0 MiB\n")
+	writeTestFile(t, apps, "100, 1024 MiB, GPU-a\n")
+
+	cfg := newTestConfig(t, "-gpu.fixture-file="+gpus, "-gpu.apps-fixture-file="+apps, "-gpu.query=fan.speed,utilization.memory,memory.used")
+	m := newTestMetrics(cfg)
+	jobs, err := walkJobs(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	devicesErr, appsErr := collectGPUMetrics(context.Background(), cfg, m, newFixtureSource(gpus), jobs)
+	if devicesErr != nil || appsErr != nil {
+		t.Fatalf("collectGPUMetrics: %v, %v", devicesErr, appsErr)
+	}
+
+	want := `
+# HELP gpu_fan_speed_percent GPU fan speed as a percentage of its maximum.
+# TYPE gpu_fan_speed_percent gauge
+gpu_fan_speed_percent{gpu_id="0"} 30
+# HELP gpu_memory_used_bytes GPU memory allocated by processes in bytes.
+# TYPE gpu_memory_used_bytes gauge
+gpu_memory_used_bytes{gpu_id="0"} 1.073741824e+09
+gpu_memory_used_bytes{gpu_id="1"} 0
+# HELP gpu_memory_utilization_percent Percentage of time the GPU memory controller was busy.
+# TYPE gpu_memory_utilization_percent gauge
+gpu_memory_utilization_percent{gpu_id="0"} 12
+gpu_memory_utilization_percent{gpu_id="1"} 0
+# HELP gpu_utilization Utilization of the whole GPU in percent, from nvidia-smi, reported for every job running processes on it.
+# TYPE gpu_utilization gauge
+gpu_utilization{gpu_id="0",job_id="42"} 45
+# HELP node_gpu_utilization_avg Average of gpu_utilization over the node's GPUs.
+# TYPE node_gpu_utilization_avg gauge
+node_gpu_utilization_avg 72.5
+`
+	if err := testutil.GatherAndCompare(m.registry, strings.NewReader(want),
+		"gpu_fan_speed_percent", "gpu_memory_used_bytes", "gpu_memory_utilization_percent", "gpu_utilization", "node_gpu_utilization_avg"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// jobGPUSeconds accumulates the GPU time each job consumed, the GPU analog of
+// CPU seconds for chargeback: every cycle adds, for each GPU of the job, its
+// share of the GPU's utilization (job_gpu_utilization_percent) as a fraction
+// times the time since the previous cycle. A GPU fully used by a job for a
+// minute adds 60 seconds, two GPUs half used add as much.
+type jobGPUSeconds struct {
+	seconds *limitedTotalCounter
+
+	totals   map[string]float64 // by job ID
+	lastTime time.Time
+	interval time.Duration // of the GPU loop
+}
+
+// newJobGPUSeconds creates the GPU-seconds counter, limited to maxSeries
+// series like the other job-level metrics, and registers it with reg.
+// interval is the GPU collection interval.
+func newJobGPUSeconds(reg prometheus.Registerer, maxSeries int, droppedSeries *prometheus.CounterVec, interval time.Duration) *jobGPUSeconds {
+	g := &jobGPUSeconds{
+		seconds: newLimitedTotalCounter(prometheus.CounterOpts{
+			Name: "job_gpu_seconds_total",
+			Help: "GPU time consumed by the job: the sum over its GPUs of its share of their utilization, as a fraction, times the time it was sampled over.",
+		}, []string{"job_id"}, maxSeries, droppedSeries),
+		totals:   make(map[string]float64),
+		interval: interval,
+	}
+	register(reg, g.seconds)
+	return g
+}
+
+// update adds the time since the previous update, weighted by the summed
+// utilization share of each job in percent, to the jobs in jobIDs, and
+// deletes the series of the other jobs. The first update only records the
+// time. The shares are assumed to have held since the previous update, even
+// if cycles failed in between, for up to maxElapsedIntervals intervals.
+func (g *jobGPUSeconds) update(jobIDs map[string]struct{}, shares map[string]float64, now time.Time) {
+	elapsed := elapsedSeconds(g.lastTime, now, g.interval)
+
+	for jobID := range g.totals {
+		if _, exists := jobIDs[jobID]; !exists {
+			g.seconds.Delete(prometheus.Labels{"job_id": jobID})
+			delete(g.totals, jobID)
+		}
+	}
+	// Exposed from 0, so that the first cycle of use is an increase.
+	for jobID := range jobIDs {
+		g.totals[jobID] += shares[jobID] / 100 * elapsed
+		g.seconds.Set(prometheus.Labels{"job_id": jobID}, g.totals[jobID])
+	}
+	g.lastTime = now
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type pidJob struct {
+	pid   string
+	jobID string
+}
+
+type ioTotals struct {
+	read  float64
+	write float64
+}
+
+// ioIncrease returns the IO of the process key since the cycle that read the
+// totals in last. A process that started since did all of its IO in the
+// meantime, so its whole total counts. The same goes for a reused PID, whose
+// totals went down.
+func ioIncrease(last map[pidJob]ioTotals, key pidJob, total ioTotals) ioTotals {
+	if previous, ok := last[key]; ok && total.read >= previous.read && total.write >= previous.write {
+		return ioTotals{read: total.read - previous.read, write: total.write - previous.write}
+	}
+	return total
+}
+
+// ioRate exposes the IO rate of each job, computed by the exporter from the
+// increase of its processes' /proc/<pid>/io totals between two cycles divided
+// by the time between them. Unlike rate() over io_read_bytes, it doesn't
+// depend on the scrape interval.
+type ioRate struct {
+	readRate  *prometheus.GaugeVec
+	writeRate *prometheus.GaugeVec
+
+	last     map[pidJob]ioTotals
+	lastTime time.Time
+	jobs     map[string]struct{}
+}
+
+// newIORate creates the IO rate metrics and registers them with reg.
+func newIORate(reg prometheus.Registerer) *ioRate {
+	r := &ioRate{
+		readRate: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "job_io_read_bytes_per_second",
+			Help: "Bytes read per second by the job's processes over the last collection cycle.",
+		}, []string{"job_id"}),
+
+		writeRate: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "job_io_write_bytes_per_second",
+			Help: "Bytes written per second by the job's processes over the last collection cycle.",
+		}, []string{"job_id"}),
+
+		last: make(map[pidJob]ioTotals),
+		jobs: make(map[string]struct{}),
+	}
+	register(reg, r.readRate, r.writeRate)
+	return r
+}
+
+// update records the totals read at now and sets the rate of every job in
+// them. The first update only records a baseline.
+func (r *ioRate) update(totals map[pidJob]ioTotals, now time.Time) {
+	// Unlike time credited to a sample, the increase did happen over the
+	// whole gap however long, so the elapsed time isn't capped.
+	if elapsed := elapsedSeconds(r.lastTime, now, 0); elapsed > 0 {
+		reads := make(map[string]float64)
+		writes := make(map[string]float64)
+		for key, total := range totals {
+			increase := ioIncrease(r.last, key, total)
+			reads[key.jobID] += increase.read
+			writes[key.jobID] += increase.write
+		}
+
+		for jobID := range r.jobs {
+			if _, exists := reads[jobID]; !exists {
+				r.readRate.DeleteLabelValues(jobID)
+				r.writeRate.DeleteLabelValues(jobID)
+				delete(r.jobs, jobID)
+			}
+		}
+		for jobID, read := range reads {
+			r.readRate.WithLabelValues(jobID).Set(read / elapsed)
+			r.writeRate.WithLabelValues(jobID).Set(writes[jobID] / elapsed)
+			r.jobs[jobID] = struct{}{}
+		}
+	}
+
+	r.last = totals
+	r.lastTime = now
+}
+
+// nodeIO exposes the IO of all the jobs of the node as counters, so that the
+// node's figure doesn't take summing the churning per-process series. The
+// processes of jobs come and go, so rather than their sum, which would then
+// decrease, the increase of every process since the previous cycle is
+// added. The first cycle adds the whole totals of the running processes.
+type nodeIO struct {
+	read  prometheus.Counter
+	write prometheus.Counter
+
+	last map[pidJob]ioTotals // by PID only, jobID is empty
+}
+
+// newNodeIO creates the node IO counters and registers them with reg.
+func newNodeIO(reg prometheus.Registerer) *nodeIO {
+	n := &nodeIO{
+		read: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "node_io_read_bytes_total",
+			Help: "Bytes the processes of all jobs on the node caused to be read from storage, from read_bytes in /proc/<pid>/io.",
+		}),
+		write: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "node_io_write_bytes_total",
+			Help: "Bytes the processes of all jobs on the node caused to be written to storage, from write_bytes in /proc/<pid>/io.",
+		}),
+		last: make(map[pidJob]ioTotals),
+	}
+	register(reg, n.read, n.write)
+	return n
+}
+
+// update adds the IO of the processes in totals since the previous update.
+// A process in several jobs counts once.
+func (n *nodeIO) update(totals map[pidJob]ioTotals) {
+	current := make(map[pidJob]ioTotals, len(totals))
+	for key, total := range totals {
+		current[pidJob{pid: key.pid}] = total
+	}
+	for key, total := range current {
+		increase := ioIncrease(n.last, key, total)
+		n.read.Add(increase.read)
+		n.write.Add(increase.write)
+	}
+	n.last = current
+}
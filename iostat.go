@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// cgroupV2Roots are where the cgroup v2 hierarchy is mounted on hybrid
+// systems, which mount cgroup v1 at /sys/fs/cgroup, and on unified ones.
+var cgroupV2Roots = []string{"/sys/fs/cgroup/unified", "/sys/fs/cgroup"}
+
+// cgroupV2Root returns the first of cgroupV2Roots that exists.
+func cgroupV2Root() string {
+	for _, root := range cgroupV2Roots {
+		if _, err := os.Stat(hostPath(filepath.Join(root, "cgroup.controllers"))); err == nil {
+			return hostPath(root)
+		}
+	}
+	return hostPath(cgroupV2Roots[len(cgroupV2Roots)-1])
+}
+
+// ioControllerAvailable reports whether the cgroup v2 io controller is
+// enabled, which io.stat needs.
+func ioControllerAvailable() bool {
+	content, err := os.ReadFile(filepath.Join(cgroupV2Root(), "cgroup.controllers"))
+	return err == nil && stringList(strings.Fields(string(content))).contains("io")
+}
+
+// resolveIOSource returns the -io.source to use, resolving auto to cgroup if
+// the io controller is available and to proc otherwise.
+func resolveIOSource(source string) string {
+	if source != "auto" {
+		return source
+	}
+	if ioControllerAvailable() {
+		return "cgroup"
+	}
+	return "proc"
+}
+
+// ioStatCollector exposes the IO of jobs from the io.stat of their cgroup v2
+// directory, which, unlike /proc/<pid>/io, breaks it down by block device,
+// e.g. to tell local scratch IO from shared filesystem IO. The device label
+// is only added with -collector.io-stat.devices, as it multiplies the
+// number of series.
+type ioStatCollector struct {
+	readBytes  *limitedTotalCounter
+	writeBytes *limitedTotalCounter
+	byDevice   bool
+	manager    string
+
+	// series holds the labels of every job's series, to delete them once
+	// the job ends.
+	series  map[string][]prometheus.Labels
+	devices map[string]string // device name by major:minor
+}
+
+// newIOStatCollector creates the io.stat collector, whose metrics are limited
+// to maxSeries series like the other job-level metrics, and registers them
+// with reg. manager is the -workload.manager the jobs come from.
+func newIOStatCollector(reg prometheus.Registerer, manager string, byDevice bool, maxSeries int, droppedSeries *prometheus.CounterVec) *ioStatCollector {
+	labelNames := []string{"job_id"}
+	if byDevice {
+		labelNames = append(labelNames, "device")
+	}
+	c := &ioStatCollector{
+		readBytes: newLimitedTotalCounter(prometheus.CounterOpts{
+			Name: "job_io_read_bytes_total",
+			Help: "Bytes read from block devices by the job, from its cgroup v2 io.stat.",
+		}, labelNames, maxSeries, droppedSeries),
+
+		writeBytes: newLimitedTotalCounter(prometheus.CounterOpts{
+			Name: "job_io_write_bytes_total",
+			Help: "Bytes written to block devices by the job, from its cgroup v2 io.stat.",
+		}, labelNames, maxSeries, droppedSeries),
+
+		byDevice: byDevice,
+		manager:  manager,
+		series:   make(map[string][]prometheus.Labels),
+		devices:  make(map[string]string),
+	}
+	register(reg, c.readBytes, c.writeBytes)
+	return c
+}
+
+// collect sets the IO counters of every job whose cgroup v2 directory can be
+// found, and removes the series of jobs that ended.
+func (c *ioStatCollector) collect(ctx context.Context, jobs []slurmJob) error {
+	current := make(map[string][]prometheus.Labels)
+	for _, job := range jobs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		dir, ok := c.jobCgroupDir(job)
+		if !ok {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, "io.stat"))
+		if err != nil {
+			if processExited(err) {
+				continue
+			}
+			return fmt.Errorf("failed to read io.stat of job %s: %v", job.ID, err)
+		}
+
+		reads := make(map[string]float64)
+		writes := make(map[string]float64)
+		for _, line := range strings.Split(string(content), "\n") {
+			// Lines look like "259:0 rbytes=1024 wbytes=0 rios=1 wios=0 dbytes=0 dios=0".
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			device := ""
+			if c.byDevice {
+				device = c.deviceName(fields[0])
+			}
+			for _, field := range fields[1:] {
+				key, value, _ := strings.Cut(field, "=")
+				n, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					continue
+				}
+				switch key {
+				case "rbytes":
+					reads[device] += n
+				case "wbytes":
+					writes[device] += n
+				}
+			}
+		}
+
+		for device, read := range reads {
+			labels := prometheus.Labels{"job_id": job.ID}
+			if c.byDevice {
+				labels["device"] = device
+			}
+			c.readBytes.Set(labels, read)
+			c.writeBytes.Set(labels, writes[device])
+			current[job.ID] = append(current[job.ID], labels)
+		}
+	}
+
+	for jobID, series := range c.series {
+		if _, exists := current[jobID]; !exists {
+			for _, labels := range series {
+				c.readBytes.Delete(labels)
+				c.writeBytes.Delete(labels)
+			}
+		}
+	}
+	c.series = current
+	return nil
+}
+
+// jobCgroupDir returns the cgroup v2 directory of job, the ancestor of its
+// processes' cgroups named after the job (job_<id>, or the pod with
+// -workload.manager=kubernetes). ok is false if none of its processes is
+// in such a cgroup, e.g. on cgroup v1.
+func (c *ioStatCollector) jobCgroupDir(job slurmJob) (string, bool) {
+	return findJobCgroup(job, c.manager, "")
+}
+
+// findJobCgroup returns the directory of job in the cgroup v1 hierarchy of
+// controller, or in the cgroup v2 hierarchy if controller is empty. It is
+// the ancestor of its processes' cgroups, as listed in /proc/<pid>/cgroup,
+// named after the job. ok is false if none of its processes is in such a
+// cgroup of that hierarchy.
+func findJobCgroup(job slurmJob, manager, controller string) (string, bool) {
+	for _, pid := range job.PIDs {
+		content, err := os.ReadFile(hostPath(fmt.Sprintf("/proc/%s/cgroup", pid)))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			// Entries look like "9:memory:/slurm/uid_1000/job_42/step_0" on
+			// cgroup v1 and "0::/system.slice/slurmstepd.scope/job_42/step_0/user/task_0"
+			// on cgroup v2.
+			parts := strings.SplitN(line, ":", 3)
+			if len(parts) != 3 {
+				continue
+			}
+			var root string
+			switch {
+			case controller == "" && parts[0] == "0" && parts[1] == "":
+				root = cgroupV2Root()
+			case controller != "" && stringList(strings.Split(parts[1], ",")).contains(controller):
+				// v1 hierarchies are mounted under the names of their
+				// controllers, e.g. /sys/fs/cgroup/cpu,cpuacct.
+				root = hostPath(filepath.Join("/sys/fs/cgroup", parts[1]))
+			default:
+				continue
+			}
+			components := strings.Split(parts[2], "/")
+			for i, name := range components {
+				if cgroupNamesJob(manager, name, job) {
+					return filepath.Join(root, strings.Join(components[:i+1], "/")), true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// cgroupNamesJob reports whether the cgroup directory name is the one of
+// job.
+func cgroupNamesJob(manager, name string, job slurmJob) bool {
+	if manager == "kubernetes" {
+		uid, ok := podUIDFromCgroup(name)
+		return ok && uid == job.ID
+	}
+	// The job's cgroup v1 directory has the same name, which, unlike its
+	// ID, isn't changed by -label.job-id-regex.
+	return name == filepath.Base(job.Dir)
+}
+
+// deviceName resolves a major:minor device number to its name, e.g.
+// nvme0n1, from /sys/dev/block. It falls back to the number itself.
+func (c *ioStatCollector) deviceName(number string) string {
+	if name, ok := c.devices[number]; ok {
+		return name
+	}
+	name := number
+	if content, err := os.ReadFile(hostPath(filepath.Join("/sys/dev/block", number, "uevent"))); err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			if devName, ok := strings.CutPrefix(line, "DEVNAME="); ok {
+				name = devName
+			}
+		}
+	}
+	c.devices[number] = name
+	return name
+}
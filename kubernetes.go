@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// kubepodsCgroupPaths are the possible roots of the Kubernetes pod cgroups in
+// the cgroup v1 cpu hierarchy, with the cgroupfs and systemd cgroup drivers.
+var kubepodsCgroupPaths = []string{
+	"/sys/fs/cgroup/cpu/kubepods",
+	"/sys/fs/cgroup/cpu/kubepods.slice",
+}
+
+// podUIDFromCgroup returns the pod UID encoded in the name of a pod cgroup
+// directory: pod<uid> with cgroupfs, or kubepods-<qos>-pod<uid>.slice with
+// systemd, which replaces the dashes of the UID by underscores.
+func podUIDFromCgroup(name string) (string, bool) {
+	if uid, ok := strings.CutPrefix(name, "pod"); ok {
+		return uid, true
+	}
+	if _, rest, ok := strings.Cut(name, "-pod"); ok && strings.HasSuffix(rest, ".slice") {
+		return strings.ReplaceAll(strings.TrimSuffix(rest, ".slice"), "_", "-"), true
+	}
+	return "", false
+}
+
+// walkKubernetesPods lists every pod under the kubepods cgroup root as a job
+// identified by the pod UID, together with the PIDs of all its containers.
+func walkKubernetesPods(ctx context.Context) ([]slurmJob, error) {
+	root, err := kubepodsCgroupRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []slurmJob
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Pods and containers come and go while walking.
+			if path != root && processExited(err) {
+				return nil
+			}
+			return err
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		uid, ok := podUIDFromCgroup(entry.Name())
+		if !ok {
+			return nil
+		}
+
+		job := slurmJob{ID: uid, Dir: path}
+		filepath.WalkDir(path, func(path string, entry fs.DirEntry, err error) error {
+			if err == nil && entry.Name() == "cgroup.procs" {
+				if pids, err := os.ReadFile(path); err == nil {
+					job.PIDs = append(job.PIDs, strings.Fields(string(pids))...)
+					job.Threads += countCgroupThreads(filepath.Dir(path))
+				}
+			}
+			return nil
+		})
+		jobs = append(jobs, job)
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// podUIDFromPID returns the UID of the pod pid runs in, from its cgroup paths
+// in /proc/<pid>/cgroup.
+func podUIDFromPID(pid string) (string, error) {
+	content, err := os.ReadFile(hostPath(fmt.Sprintf("/proc/%s/cgroup", pid)))
+	if processExited(err) {
+		return "", fmt.Errorf("PID %s has exited: %w", pid, ErrJobNotFound)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read the cgroups of PID %s: %w", pid, err)
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		// Lines look like "4:cpu,cpuacct:/kubepods/burstable/pod<uid>/<container>".
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		for _, name := range strings.Split(parts[2], "/") {
+			if uid, ok := podUIDFromCgroup(name); ok {
+				return uid, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("PID %s: %w", pid, ErrJobNotFound)
+}
+
+// kubepodsCgroupRoot returns the first of kubepodsCgroupPaths that exists.
+func kubepodsCgroupRoot() (string, error) {
+	for _, path := range kubepodsCgroupPaths {
+		if info, err := os.Stat(hostPath(path)); err == nil && info.IsDir() {
+			return hostPath(path), nil
+		}
+	}
+	return "", fmt.Errorf("none of %s exists", strings.Join(kubepodsCgroupPaths, ", "))
+}
+
+func checkKubepodsRoot() checkResult {
+	r := checkResult{name: "kubepods cgroup root"}
+	root, err := kubepodsCgroupRoot()
+	if err != nil {
+		r.detail = err.Error()
+		return r
+	}
+	r.ok = true
+	r.detail = fmt.Sprintf("%s exists", root)
+	return r
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// seriesLimit tracks the series of a metric vector and stops admitting new
+// ones once it holds limit of them, as a safety valve against unbounded
+// cardinality (e.g. from PID churn). Existing series keep being updated;
+// dropped updates are counted in job_exporter_dropped_series_total. A limit
+// of 0 disables the guard.
+type seriesLimit struct {
+	name       string
+	labelNames []string
+	limit      int
+	dropped    prometheus.Counter
+
+	mu     sync.Mutex
+	series map[string]prometheus.Labels
+	warned bool
+}
+
+func newSeriesLimit(name string, labelNames []string, limit int, droppedSeries *prometheus.CounterVec) seriesLimit {
+	return seriesLimit{
+		name:       name,
+		labelNames: labelNames,
+		limit:      limit,
+		dropped:    droppedSeries.WithLabelValues(name),
+		series:     make(map[string]prometheus.Labels),
+	}
+}
+
+// admit reports whether the series identified by labels may be updated, i.e.
+// whether it exists or there is room for it, and tracks it if so.
+func (l *seriesLimit) admit(labels prometheus.Labels) bool {
+	key := labelsKey(l.labelNames, labels)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, exists := l.series[key]; exists {
+		return true
+	}
+	if l.limit > 0 && len(l.series) >= l.limit {
+		if !l.warned {
+			fmt.Printf("WARN: %s reached the limit of %d series, dropping new ones\n", l.name, l.limit)
+			l.warned = true
+		}
+		l.dropped.Inc()
+		return false
+	}
+	series := make(prometheus.Labels, len(labels))
+	for name, value := range labels {
+		series[name] = value
+	}
+	l.series[key] = series
+	return true
+}
+
+// forget stops tracking the series identified by labels, freeing room for a
+// new one.
+func (l *seriesLimit) forget(labels prometheus.Labels) {
+	l.mu.Lock()
+	delete(l.series, labelsKey(l.labelNames, labels))
+	if len(l.series) < l.limit {
+		l.warned = false
+	}
+	l.mu.Unlock()
+}
+
+// forgetPartialMatch stops tracking every series whose labels include labels.
+func (l *seriesLimit) forgetPartialMatch(labels prometheus.Labels) {
+	l.mu.Lock()
+	for key, series := range l.series {
+		matches := true
+		for name, value := range labels {
+			if series[name] != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			delete(l.series, key)
+		}
+	}
+	if len(l.series) < l.limit {
+		l.warned = false
+	}
+	l.mu.Unlock()
+}
+
+// limitedGaugeVec is a GaugeVec holding at most a limited number of series,
+// see seriesLimit.
+type limitedGaugeVec struct {
+	*prometheus.GaugeVec
+	seriesLimit
+}
+
+// newLimitedGaugeVec returns a GaugeVec holding at most limit series, which
+// counts dropped updates in droppedSeries under its name.
+func newLimitedGaugeVec(opts prometheus.GaugeOpts, labelNames []string, limit int, droppedSeries *prometheus.CounterVec) *limitedGaugeVec {
+	return &limitedGaugeVec{
+		GaugeVec:    prometheus.NewGaugeVec(opts, labelNames),
+		seriesLimit: newSeriesLimit(opts.Name, labelNames, limit, droppedSeries),
+	}
+}
+
+// Set sets the series identified by labels to value, unless that would create
+// a series beyond the limit.
+func (v *limitedGaugeVec) Set(labels prometheus.Labels, value float64) {
+	if v.admit(labels) {
+		v.With(labels).Set(value)
+	}
+}
+
+// Delete removes the series identified by labels, freeing room for a new one.
+func (v *limitedGaugeVec) Delete(labels prometheus.Labels) bool {
+	v.forget(labels)
+	return v.GaugeVec.Delete(labels)
+}
+
+// DeletePartialMatch removes every series whose labels include labels, e.g.
+// all series of a job, and returns how many were removed.
+func (v *limitedGaugeVec) DeletePartialMatch(labels prometheus.Labels) int {
+	v.forgetPartialMatch(labels)
+	return v.GaugeVec.DeletePartialMatch(labels)
+}
+
+// limitedTotalCounter is a totalCounter holding at most a limited number of
+// series, see seriesLimit.
+type limitedTotalCounter struct {
+	*totalCounter
+	seriesLimit
+}
+
+// newLimitedTotalCounter returns a totalCounter holding at most limit series,
+// which counts dropped updates in droppedSeries under its name.
+func newLimitedTotalCounter(opts prometheus.CounterOpts, labelNames []string, limit int, droppedSeries *prometheus.CounterVec) *limitedTotalCounter {
+	return &limitedTotalCounter{
+		totalCounter: newTotalCounter(opts, labelNames),
+		seriesLimit:  newSeriesLimit(opts.Name, labelNames, limit, droppedSeries),
+	}
+}
+
+// Set records total for the series identified by labels, unless that would
+// create a series beyond the limit.
+func (c *limitedTotalCounter) Set(labels prometheus.Labels, total float64) {
+	if c.admit(labels) {
+		c.totalCounter.Set(labels, total)
+	}
+}
+
+// Delete removes the series identified by labels, freeing room for a new one.
+func (c *limitedTotalCounter) Delete(labels prometheus.Labels) bool {
+	c.forget(labels)
+	return c.totalCounter.Delete(labels)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus/testutil/promlint"
+)
+
+// runLint runs one collection cycle, checks the metrics it exposes against
+// the Prometheus naming conventions with promlint, prints the problems found
+// and returns false if there is any. Only metrics with series are checked,
+// so for the job metrics to be it has to run on a node with jobs, and for
+// the GPU metrics on one with GPUs or with -gpu.fixture-file.
+func runLint(cfg *Config) bool {
+	problems, linted, err := lintMetrics(cfg)
+	if err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		return false
+	}
+	for _, problem := range problems {
+		fmt.Printf("%s: %s\n", problem.Metric, problem.Text)
+	}
+	fmt.Printf("%d metrics linted, %d problems found\n", linted, len(problems))
+	return len(problems) == 0
+}
+
+// lintMetrics runs one collection cycle and returns the problems promlint
+// finds in the metrics it exposes, and the number of metrics linted.
+func lintMetrics(cfg *Config) ([]promlint.Problem, int, error) {
+	// The background loops are stopped right away, the final cycle being
+	// the one linted.
+	ctx, cancel := context.WithCancel(context.Background())
+	gatherer, final := startCollection(ctx, cfg, nil, nil)
+	cancel()
+	final(context.Background())
+
+	families, err := gatherer.Gather()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to gather the metrics: %w", err)
+	}
+	problems, err := promlint.NewWithMetricFamilies(families).Lint()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to lint the metrics: %w", err)
+	}
+	return problems, len(families), nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+// knownLintProblems are the problems promlint finds in metrics that predate
+// the lint and can't be renamed without breaking dashboards.
+var knownLintProblems = map[string]bool{
+	"gpu_process_count": true,
+	"job_gpu_count":     true,
+	"job_process_count": true,
+	"job_thread_count":  true,
+	"node_gpu_count":    true,
+}
+
+func TestLintMetrics(t *testing.T) {
+	newTestRootfs(t, map[string]string{
+		testJobDir + "/cgroup.procs":        "100\n",
+		testJobDir + "/step_0/cgroup.procs": "101\n",
+		"/proc/100/io":                      "read_bytes: 4096\nwrite_bytes: 8192\n",
+		"/proc/100/cgroup":                  "4:cpu,cpuacct:/slurm/uid_1000/job_42\n",
+		"/proc/101/io":                      "read_bytes: 1000000\nwrite_bytes: 0\n",
+		"/proc/101/cgroup":                  "4:cpu,cpuacct:/slurm/uid_1000/job_42/step_0\n",
+	})
+	cfg := newTestConfig(t, "-gpu.fixture-file=testdata/gpus.csv", "-gpu.apps-fixture-file=testdata/apps.csv", "-metrics.granularity=both")
+
+	problems, linted, err := lintMetrics(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linted == 0 {
+		t.Fatal("lintMetrics() linted no metrics")
+	}
+	for _, problem := range problems {
+		if !knownLintProblems[problem.Metric] {
+			t.Errorf("%s: %s", problem.Metric, problem.Text)
+		}
+	}
+}
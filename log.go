@@ -0,0 +1,13 @@
+package main
+
+import "fmt"
+
+// debugEnabled is set by -log.debug.
+var debugEnabled bool
+
+// debugf logs details that are too noisy to print every cycle by default.
+func debugf(format string, args ...interface{}) {
+	if debugEnabled {
+		fmt.Printf("DEBUG: "+format+"\n", args...)
+	}
+}
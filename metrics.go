@@ -2,286 +2,1882 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"math/rand"
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 )
 
-var (
-	gpuUtilizationMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+// slurmCgroupPath is the default root of the Slurm cgroup v1 hierarchy that
+// holds the uid_<uid>/job_<id> directories walked by the collectors.
+const slurmCgroupPath = "/sys/fs/cgroup/cpu/slurm"
+
+// rootfs is the root under which the exporter reads /proc and /sys. It is
+// only changed to point the collectors at a fake tree.
+var rootfs = "/"
+
+// hostPath returns path, an absolute /proc or /sys path, under rootfs.
+func hostPath(path string) string {
+	return filepath.Join(rootfs, path)
+}
+
+// exporterMetrics holds the metrics of the collectors, registered on their own
+// registry rather than the default one so that exporters don't share state.
+// Optional collectors own their metrics and register them on the same
+// registry when enabled, through registerer, which adds the -label.extra
+// labels and leaves out the metrics of -metrics.disable.
+type exporterMetrics struct {
+	registry   *prometheus.Registry
+	registerer prometheus.Registerer
+
+	gpuUtilization       *limitedGaugeVec
+	jobGPUUtilization    *limitedGaugeVec
+	gpuMemoryUsage       *limitedGaugeVec
+	jobGPUMemoryUsage    *limitedGaugeVec
+	jobGPUMemoryMax      *limitedGaugeVec
+	jobGPUCount          *limitedGaugeVec
+	jobGPUAllocatedIndex *limitedGaugeVec
+	jobProcessCount      *limitedGaugeVec
+	jobThreadCount       *limitedGaugeVec
+	jobState             *limitedGaugeVec
+	// The pid-labeled IO metrics are nil with -metrics.granularity=job, and
+	// the job-level ones with -metrics.granularity=pid. The deprecated
+	// gauges replace the counters with -metrics.legacy-io-gauges, as
+	// OpenMetrics doesn't allow both names.
+	ioReadBytes        *limitedTotalCounter
+	ioWriteBytes       *limitedTotalCounter
+	legacyIOReadBytes  *limitedGaugeVec
+	legacyIOWriteBytes *limitedGaugeVec
+	jobIOReadBytes     *limitedGaugeVec
+	jobIOWriteBytes    *limitedGaugeVec
+	gpuEccErrors       *totalCounter
+	gpuComputeMode     *prometheus.GaugeVec
+	gpuPersistenceMode *prometheus.GaugeVec
+	gpuProcessCount    *prometheus.GaugeVec
+	gpuProfiling       map[string]*prometheus.GaugeVec
+	gpuBAR1            map[string]*prometheus.GaugeVec
+	gpuGauges          map[string]*prometheus.GaugeVec
+	ioRate             *ioRate
+	nodeIO             *nodeIO      // nil with -io.source=cgroup
+	gpuThrottle        *gpuThrottle // nil unless clocks_throttle_reasons.active is queried
+	jobGPUSeconds      *jobGPUSeconds
+	clockWatch         *clockWatch
+	topology           *gpuTopology // nil without -gpu.topology-file
+	onlyActive         bool
+	gpuPresence        *gpuPresence
+	nodeGPU            *nodeGPUMetrics
+
+	// shapeJobIDs are the jobs of the last cgroup walk, whose process and
+	// thread counts are deleted once they end.
+	shapeJobIDs map[string]struct{}
+	// jobStates are the job_state of the jobs of the last cgroup walk, by
+	// job ID.
+	jobStates map[string]string
+	// ioJobIDs are the jobs of the last IO cycle, whose job-level series
+	// are deleted once they end.
+	ioJobIDs map[string]struct{}
+	// ioPIDs are the processes of the last IO cycle, whose pid-labeled
+	// series are deleted once they exit.
+	ioPIDs map[pidJob]struct{}
+	// gpuJobIDs are the jobs of the last GPU cycle, whose series are
+	// deleted once they end.
+	gpuJobIDs map[string]struct{}
+	// gpuAllocations are the allocated GPUs of the last GPU cycle, whose
+	// job_gpu_allocated_index series are deleted once they go away.
+	gpuAllocations map[gpuJob]struct{}
+	// lastGPUs are the GPUs of the last successful device query, which the
+	// compute apps are attributed to while it fails.
+	lastGPUs []gpuInfo
+	// gpuMemoryPeaks holds job_gpu_memory_max_bytes by job ID and GPU index.
+	gpuMemoryPeaks map[string]map[string]float64
+
+	// jobs is nil unless -debug.endpoints is set.
+	jobs *jobSnapshot
+	// errors is nil unless -debug.endpoints is set.
+	errors *errorLog
+
+	clock clock
+
+	collectionErrors *prometheus.CounterVec
+	lastCollection   *prometheus.GaugeVec
+	droppedSeries    *prometheus.CounterVec
+	unmatchedGPU     prometheus.Counter
+	pidAttribution   *prometheus.CounterVec
+	cgroupWalk       prometheus.Gauge
+	ready            prometheus.Gauge
+
+	ioPermissionDenied prometheus.Counter
+	// ioDeniedPIDs are the PIDs whose denied /proc/<pid>/io read has been
+	// logged, so that it is logged once per PID rather than every cycle.
+	ioDeniedPIDs map[string]struct{}
+	// devicesListMissingLogged is set once a job without a devices.list,
+	// whose GPU allocation is unknown, has been logged.
+	devicesListMissingLogged bool
+	// procIO is false with -io.source=cgroup, which reads the IO of jobs
+	// from io.stat instead of /proc/<pid>/io.
+	procIO bool
+}
+
+// register registers each collector with reg. Unlike MustRegister, a
+// collector that is already registered, e.g. by an embedding program or a
+// second call, is logged and skipped rather than a panic; the one registered
+// first keeps being exposed. Other errors, which mean an invalid metric, still
+// panic.
+func register(reg prometheus.Registerer, cs ...prometheus.Collector) {
+	for _, c := range cs {
+		err := reg.Register(c)
+		var alreadyRegistered prometheus.AlreadyRegisteredError
+		if errors.As(err, &alreadyRegistered) {
+			fmt.Printf("WARN: Skipping %s, already registered\n", strings.Join(collectorNames(c), ", "))
+			continue
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// newExporterMetrics creates and registers the metrics, including the gauges
+// of the gpuGaugeFields selected in gpu and the IO metrics of the granularity
+// selected in cfg. Job-level metrics, whose label values churn, hold at most
+// cfg.MaxSeries series each. extraLabels are added to every metric. The
+// runtime metrics of the exporter's own process are left to the caller, so
+// that the output only depends on what the collectors read, e.g. from a fake
+// rootfs and -gpu.fixture-file, and the clock.
+func newExporterMetrics(cfg MetricsConfig, gpu GPUConfig, extraLabels map[string]string) *exporterMetrics {
+	maxSeries := cfg.MaxSeries
+	registry := prometheus.NewRegistry()
+	m := &exporterMetrics{
+		registry:   registry,
+		registerer: newDisablingRegisterer(prometheus.WrapRegistererWith(extraLabels, registry), cfg.Disable),
+
+		gpuEccErrors: newTotalCounter(prometheus.CounterOpts{
+			Name: "gpu_ecc_errors_total",
+			Help: "Aggregate GPU ECC errors by type (corrected or uncorrected), from nvidia-smi.",
+		}, []string{"gpu_id", "type"}),
+
+		gpuComputeMode: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gpu_compute_mode",
+			Help: "Always 1, labeled with the GPU's compute mode (e.g. Default, Exclusive_Process).",
+		}, []string{"gpu_id", "mode"}),
+
+		gpuPersistenceMode: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gpu_persistence_mode",
+			Help: "Always 1, labeled with the GPU's persistence mode (Enabled or Disabled).",
+		}, []string{"gpu_id", "mode"}),
+
+		gpuProcessCount: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gpu_process_count",
+			Help: "Number of compute processes on the GPU, whether or not they belong to a job.",
+		}, []string{"gpu_id"}),
+
+		gpuProfiling: newGPUProfilingMetrics(),
+		gpuBAR1:      newGPUBAR1Metrics(),
+
+		gpuGauges: make(map[string]*prometheus.GaugeVec),
+
+		collectionErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "job_exporter_collection_errors_total",
+			Help: "Collection cycles that failed, by collector.",
+		}, []string{"collector"}),
+
+		lastCollection: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "job_exporter_last_collection_timestamp_seconds",
+			Help: "Unix time of the last successful collection cycle, by collector.",
+		}, []string{"collector"}),
+
+		droppedSeries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "job_exporter_dropped_series_total",
+			Help: "Updates dropped because the metric reached its series limit.",
+		}, []string{"metric"}),
+
+		unmatchedGPU: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "job_exporter_unmatched_gpu_total",
+			Help: "GPU compute apps dropped because their GPU UUID matched no GPU from the device query, e.g. MIG instances.",
+		}),
+
+		pidAttribution: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "job_exporter_pid_attribution_failures_total",
+			Help: "GPU compute apps whose PID was attributed to no job, by reason: not_found (in no job cgroup, e.g. started outside the workload manager) or error (the job cgroups couldn't be read).",
+		}, []string{"reason"}),
+
+		cgroupWalk: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "job_exporter_cgroup_walk_seconds",
+			Help: "Duration of the last walk of the job cgroup hierarchy by the IO collector, excluding the /proc/<pid>/io reads.",
+		}),
+
+		ready: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "job_exporter_ready",
+			Help: "1 once the exporter has completed a cycle of both the job and the GPU collection, or of the GPU collection alone without job cgroups, 0 before.",
+		}),
+
+		ioPermissionDenied: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "job_exporter_io_permission_denied_total",
+			Help: "Reads of /proc/<pid>/io denied for lack of privileges (CAP_SYS_PTRACE or root).",
+		}),
+		ioDeniedPIDs: make(map[string]struct{}),
+
+		ioJobIDs: make(map[string]struct{}),
+		ioPIDs:   make(map[pidJob]struct{}),
+
+		gpuMemoryPeaks: make(map[string]map[string]float64),
+
+		clock: realClock{},
+	}
+
+	m.gpuUtilization = newLimitedGaugeVec(prometheus.GaugeOpts{
 		Name: "gpu_utilization",
-		Help: "GPU utilization percentage.",
-	}, []string{"gpu_id", "job_id"})
+		Help: "Utilization of the whole GPU in percent, from nvidia-smi, reported for every job running processes on it.",
+	}, []string{"gpu_id", "job_id"}, maxSeries, m.droppedSeries)
 
-	gpuMemoryUsageMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	m.jobGPUUtilization = newLimitedGaugeVec(prometheus.GaugeOpts{
+		Name: "job_gpu_utilization_percent",
+		Help: "Share of the GPU's utilization attributed to the job, by the SM utilization of its processes with -collector.process-utilization, otherwise split equally between the jobs on the GPU.",
+	}, []string{"gpu_id", "job_id"}, maxSeries, m.droppedSeries)
+
+	m.gpuMemoryUsage = newLimitedGaugeVec(memoryGaugeOpts(prometheus.GaugeOpts{
 		Name: "gpu_memory_usage_bytes",
-		Help: "GPU memory usage in bytes.",
-	}, []string{"gpu_id", "job_id"})
-
-	ioReadBytesMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "io_read_bytes",
-		Help: "IO read bytes.",
-	}, []string{"pid", "job_id"})
-
-	ioWriteBytesMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "io_write_bytes",
-		Help: "IO write bytes.",
-	}, []string{"pid", "job_id"})
-)
+		Help: "GPU memory used by the job's processes on the GPU in bytes, from the nvidia-smi compute apps.",
+	}), []string{"gpu_id", "job_id"}, maxSeries, m.droppedSeries)
+
+	m.jobGPUMemoryUsage = newLimitedGaugeVec(memoryGaugeOpts(prometheus.GaugeOpts{
+		Name: "job_gpu_memory_usage_bytes",
+		Help: "GPU memory usage of the job in bytes, summed over its GPUs.",
+	}), []string{"job_id"}, maxSeries, m.droppedSeries)
+
+	m.jobGPUMemoryMax = newLimitedGaugeVec(memoryGaugeOpts(prometheus.GaugeOpts{
+		Name: "job_gpu_memory_max_bytes",
+		Help: "Peak GPU memory usage of the job in bytes observed by the collection cycles since the job started.",
+	}), []string{"gpu_id", "job_id"}, maxSeries, m.droppedSeries)
+
+	m.jobGPUCount = newLimitedGaugeVec(prometheus.GaugeOpts{
+		Name: "job_gpu_count",
+		Help: "Number of GPUs the job runs processes on.",
+	}, []string{"job_id"}, maxSeries, m.droppedSeries)
+
+	m.jobGPUAllocatedIndex = newLimitedGaugeVec(prometheus.GaugeOpts{
+		Name: "job_gpu_allocated_index",
+		Help: "Always 1, for each GPU in the job's devices cgroup allowlist, i.e. allocated to the job by Slurm with ConstrainDevices=yes.",
+	}, []string{"gpu_id", "job_id"}, maxSeries, m.droppedSeries)
+
+	m.jobProcessCount = newLimitedGaugeVec(prometheus.GaugeOpts{
+		Name: "job_process_count",
+		Help: "Number of processes in the job's cgroup.",
+	}, []string{"job_id"}, maxSeries, m.droppedSeries)
+
+	m.jobThreadCount = newLimitedGaugeVec(prometheus.GaugeOpts{
+		Name: "job_thread_count",
+		Help: "Number of threads of the processes in the job's cgroup.",
+	}, []string{"job_id"}, maxSeries, m.droppedSeries)
+
+	m.jobState = newLimitedGaugeVec(prometheus.GaugeOpts{
+		Name: "job_state",
+		Help: "Always 1, labeled with the job's state: suspended if all of its processes are stopped, e.g. by Slurm suspending it, running otherwise.",
+	}, []string{"job_id", "state"}, maxSeries, m.droppedSeries)
+
+	register(m.registerer,
+		m.gpuUtilization,
+		m.jobGPUUtilization,
+		m.gpuMemoryUsage,
+		m.jobGPUMemoryUsage,
+		m.jobGPUMemoryMax,
+		m.jobGPUCount,
+		m.jobGPUAllocatedIndex,
+		m.jobProcessCount,
+		m.jobThreadCount,
+		m.jobState,
+		m.gpuEccErrors,
+		m.gpuComputeMode,
+		m.gpuPersistenceMode,
+		m.gpuProcessCount,
+		m.collectionErrors,
+		m.droppedSeries,
+		m.lastCollection,
+		m.unmatchedGPU,
+		m.pidAttribution,
+		m.cgroupWalk,
+		m.ready,
+		m.ioPermissionDenied,
+	)
+	if cfg.Granularity != "job" && !cfg.LegacyIOGauges {
+		m.ioReadBytes = newLimitedTotalCounter(prometheus.CounterOpts{
+			Name: "io_read_bytes_total",
+			Help: "Bytes the process caused to be read from storage, from read_bytes in /proc/<pid>/io.",
+		}, []string{"pid", "job_id"}, maxSeries, m.droppedSeries)
+
+		m.ioWriteBytes = newLimitedTotalCounter(prometheus.CounterOpts{
+			Name: "io_write_bytes_total",
+			Help: "Bytes the process caused to be written to storage, from write_bytes in /proc/<pid>/io.",
+		}, []string{"pid", "job_id"}, maxSeries, m.droppedSeries)
+
+		register(m.registerer, m.ioReadBytes, m.ioWriteBytes)
+	}
+	if cfg.Granularity != "job" && cfg.LegacyIOGauges {
+		m.legacyIOReadBytes = newLimitedGaugeVec(prometheus.GaugeOpts{
+			Name: "io_read_bytes",
+			Help: "Deprecated, use io_read_bytes_total. Bytes the process caused to be read from storage, from read_bytes in /proc/<pid>/io.",
+		}, []string{"pid", "job_id"}, maxSeries, m.droppedSeries)
+
+		m.legacyIOWriteBytes = newLimitedGaugeVec(prometheus.GaugeOpts{
+			Name: "io_write_bytes",
+			Help: "Deprecated, use io_write_bytes_total. Bytes the process caused to be written to storage, from write_bytes in /proc/<pid>/io.",
+		}, []string{"pid", "job_id"}, maxSeries, m.droppedSeries)
+
+		register(m.registerer, m.legacyIOReadBytes, m.legacyIOWriteBytes)
+	}
+	if cfg.Granularity != "pid" {
+		m.jobIOReadBytes = newLimitedGaugeVec(prometheus.GaugeOpts{
+			Name: "job_proc_io_read_bytes",
+			Help: "Bytes the job's running processes caused to be read from storage, summed over their /proc/<pid>/io.",
+		}, []string{"job_id"}, maxSeries, m.droppedSeries)
+
+		m.jobIOWriteBytes = newLimitedGaugeVec(prometheus.GaugeOpts{
+			Name: "job_proc_io_write_bytes",
+			Help: "Bytes the job's running processes caused to be written to storage, summed over their /proc/<pid>/io.",
+		}, []string{"job_id"}, maxSeries, m.droppedSeries)
+
+		register(m.registerer, m.jobIOReadBytes, m.jobIOWriteBytes)
+	}
+	for _, metric := range m.gpuProfiling {
+		register(m.registerer, metric)
+	}
+	for _, metric := range m.gpuBAR1 {
+		register(m.registerer, metric)
+	}
+	for _, field := range gpu.Query {
+		if def, ok := gpuGaugeFields[field]; ok {
+			m.gpuGauges[field] = prometheus.NewGaugeVec(memoryGaugeOpts(prometheus.GaugeOpts{
+				Name: def.name,
+				Help: def.help,
+			}), []string{"gpu_id"})
+			register(m.registerer, m.gpuGauges[field])
+		}
+	}
+	if gpu.Query.contains(gpuThrottleField) {
+		m.gpuThrottle = newGPUThrottle(m.registerer, gpu.Interval)
+	}
+	m.ioRate = newIORate(m.registerer)
+	m.jobGPUSeconds = newJobGPUSeconds(m.registerer, maxSeries, m.droppedSeries, gpu.Interval)
+	m.clockWatch = newClockWatch(m.registerer)
+	m.topology = gpu.topology
+	m.onlyActive = gpu.OnlyActive
+	m.gpuPresence = newGPUPresence(m.registerer, gpu)
+	m.nodeGPU = newNodeGPUMetrics(m.registerer)
+
+	// Expose the error counters from the start so they can be alerted on.
+	m.collectionErrors.WithLabelValues("io")
+	m.collectionErrors.WithLabelValues("gpu")
+	m.collectionErrors.WithLabelValues("gpu_apps")
+	m.pidAttribution.WithLabelValues("not_found")
+	m.pidAttribution.WithLabelValues("error")
 
-func init() {
-	// Register the custom metrics with Prometheus's default registry
-	prometheus.MustRegister(gpuUtilizationMetric)
-	prometheus.MustRegister(gpuMemoryUsageMetric)
-	prometheus.MustRegister(ioReadBytesMetric)
-	prometheus.MustRegister(ioWriteBytesMetric)
+	return m
 }
 
-// getJobIDFromPID finds the job ID for a given PID from the Slurm cgroup directory
-func getJobIDFromPID(pid string) (string, error) {
-	basePath := "/sys/fs/cgroup/cpu/slurm"
+// ErrJobNotFound is returned by getJobIDFromPID for a PID that doesn't belong
+// to any job, e.g. a process started outside of Slurm or one that has exited
+// since. Unlike the filesystem errors it wraps, it is expected.
+var ErrJobNotFound = errors.New("job not found")
 
-	baseDir, err := os.Open(basePath)
-	if err != nil {
-		return "", fmt.Errorf("failed to open the base directory: %v", err)
+// getJobIDFromPID finds the job ID for a given PID from the Slurm cgroup directories
+func getJobIDFromPID(ctx context.Context, cfg *Config, pid string) (string, error) {
+	if cfg.Workload.Manager == "kubernetes" {
+		return podUIDFromPID(pid)
 	}
-	defer baseDir.Close()
 
-	entries, err := baseDir.Readdirnames(-1)
+	found := false
+	for _, root := range cfg.Cgroup.SlurmPaths {
+		jobID, err := findJobInSlurmRoot(ctx, cfg, hostPath(root), pid)
+		// Mixed setups may lack some of the roots.
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		found = true
+		if errors.Is(err, ErrJobNotFound) {
+			continue
+		}
+		return jobID, err
+	}
+	if !found {
+		return "", fmt.Errorf("none of %s exists", strings.Join(cfg.Cgroup.SlurmPaths, ", "))
+	}
+	return "", fmt.Errorf("PID %s: %w", pid, ErrJobNotFound)
+}
+
+// findJobInSlurmRoot finds the job ID for a given PID under the Slurm cgroup
+// root basePath.
+func findJobInSlurmRoot(ctx context.Context, cfg *Config, basePath, pid string) (string, error) {
+	dirs, err := findSlurmJobDirs(ctx, cfg.Cgroup.slurmJobPatterns, basePath)
 	if err != nil {
-		return "", fmt.Errorf("failed to read the entries in the directory: %v", err)
+		return "", err
 	}
 
-	for _, entry := range entries {
-		if strings.HasPrefix(entry, "uid_") {
-			uidPath := fmt.Sprintf("%s/%s", basePath, entry)
-			uidDir, err := os.Open(uidPath)
-			if err != nil {
-				continue
-			}
+	// Task PIDs of thread-heavy jobs may only be listed as threads. Thread
+	// lists are scanned after cgroup.procs, so a PID listed in both still
+	// resolves through cgroup.procs.
+	pidFiles := []string{"cgroup.procs"}
+	if cfg.Slurm.ScanThreads {
+		// cgroup.threads on cgroup v2, tasks on cgroup v1.
+		pidFiles = append(pidFiles, "cgroup.threads", "tasks")
+	}
 
-			jobEntries, err := uidDir.Readdirnames(-1)
-			uidDir.Close()
-			if err != nil {
-				continue
+	owner := ""
+	for _, dir := range dirs {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		uid := dir.uid
+		if uid == "" {
+			if owner == "" {
+				owner = processUID(pid)
 			}
+			uid = owner
+		}
+		if !cfg.Slurm.walksUID(uid) {
+			continue
+		}
+		found, err := cgroupTreeContains(dir.path, pidFiles, pid)
+		if err != nil {
+			return "", err
+		}
+		if !found {
+			continue
+		}
+		if jobID, ok := cfg.Label.jobID(dir.rawID); ok {
+			return jobID, nil
+		}
+		return "", fmt.Errorf("PID %s is in the skipped cgroup %s: %w", pid, dir.path, ErrJobNotFound)
+	}
 
-			for _, jobEntry := range jobEntries {
-				if strings.HasPrefix(jobEntry, "job_") {
-					jobPath := fmt.Sprintf("%s/%s/cgroup.procs", uidPath, jobEntry)
-					file, err := os.Open(jobPath)
-					if err != nil {
-						continue
-					}
+	return "", fmt.Errorf("PID %s: %w", pid, ErrJobNotFound)
+}
 
-					scanner := bufio.NewScanner(file)
-					for scanner.Scan() {
-						line := scanner.Text()
-						if line == pid {
-							file.Close()
-							return strings.TrimPrefix(jobEntry, "job_"), nil
-						}
-					}
-					file.Close()
+// cgroupFileContains reports whether pid is listed in the cgroup file at path,
+// such as cgroup.procs. A file that can't be opened doesn't contain it.
+func cgroupFileContains(path, pid string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, nil
+	}
+	defer file.Close()
 
-					if err := scanner.Err(); err != nil {
-						return "", fmt.Errorf("error scanning cgroup file for PID %s in %s: %v", pid, jobPath, err)
-					}
-				}
-			}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if scanner.Text() == pid {
+			return true, nil
 		}
 	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("error scanning cgroup file for PID %s in %s: %w", pid, path, err)
+	}
+	return false, nil
+}
+
+// gpuJob identifies the series of a job on a GPU.
+type gpuJob struct {
+	gpuID string
+	jobID string
+}
 
-	return "", fmt.Errorf("job ID not found for PID %s", pid)
+// gpuCycle is what a GPU collection cycle read. It is gathered in full
+// before any metric is updated, so that a cycle failing midway leaves the
+// values of the previous one intact rather than a mix of both. The device
+// query and the compute apps fail independently, so each part is only applied
+// if it was read: devicesErr and appsErr are the errors of the parts that
+// weren't.
+type gpuCycle struct {
+	jobs   []slurmJob
+	jobIDs map[string]struct{}
+
+	devicesErr error
+	appsErr    error
+
+	gpus        []gpuInfo          // without the excluded GPUs
+	utilization map[string]float64 // by GPU index
+
+	// A job can run several processes on the same GPU, so their memory and
+	// SM utilization are summed per (gpu_id, job_id).
+	jobMemory map[gpuJob]float64
+	jobSM     map[string]map[string]float64 // by GPU index and job ID
+
+	// allocated are the GPUs in each job's devices cgroup allowlist, and
+	// idle those of them the job runs nothing on.
+	allocated map[gpuJob]struct{}
+	idle      map[gpuJob]struct{}
+
+	// processes are the PIDs of the compute apps on each GPU, by index.
+	processes map[string]map[string]struct{}
 }
 
-func collectGPUMetrics(jobIDs map[string]struct{}) {
-	gpuInfoCmd := exec.Command("bash", "-c", "nvidia-smi --query-gpu=gpu_uuid,index,name,utilization.gpu --format=csv,noheader")
-	gpuInfoOutput, err := gpuInfoCmd.Output()
+// collectGPUMetrics runs a GPU cycle and returns the errors of its device
+// query and of its compute apps, which are counted separately.
+func collectGPUMetrics(ctx context.Context, cfg *Config, m *exporterMetrics, source gpuSource, jobs []slurmJob) (devicesErr, appsErr error) {
+	cycle, err := readGPUCycle(ctx, cfg, m, source, jobs)
 	if err != nil {
-		fmt.Printf("WARN: Failed to execute command: %s\n", err)
-		return
+		return err, err
+	}
+	cycle.apply(m)
+	return cycle.devicesErr, cycle.appsErr
+}
+
+// readGPUCycle queries the GPUs and attributes their compute apps to jobs.
+// It only updates the diagnostic metrics: gpu_present and the unmatched GPU
+// counter. The error is only set, without a cycle, if ctx was cancelled.
+func readGPUCycle(ctx context.Context, cfg *Config, m *exporterMetrics, source gpuSource, jobs []slurmJob) (*gpuCycle, error) {
+	cycle := &gpuCycle{
+		jobs:        jobs,
+		jobIDs:      slurmJobIDs(jobs),
+		utilization: make(map[string]float64),
+		jobMemory:   make(map[gpuJob]float64),
+		jobSM:       make(map[string]map[string]float64),
+		allocated:   make(map[gpuJob]struct{}),
+		idle:        make(map[gpuJob]struct{}),
+		processes:   make(map[string]map[string]struct{}),
 	}
 
-	computeAppsCmd := exec.Command("bash", "-c", "nvidia-smi --query-compute-apps=pid,used_gpu_memory,gpu_uuid --format=csv,noheader")
-	computeAppsOutput, err := computeAppsCmd.Output()
+	gpus, err := source.queryGPUs(ctx)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	if err != nil {
-		fmt.Printf("WARN: Failed to execute command: %s\n", err)
-		return
+		// nvidia-smi fails as a whole when a GPU has fallen off the bus.
+		m.gpuPresence.update(nil)
+		cycle.devicesErr = fmt.Errorf("failed to query GPUs: %v", err)
+		// The compute apps can still be attributed to the GPUs of the last
+		// successful query.
+		gpus = m.lastGPUs
+	} else {
+		gpus = validGPUs(gpus)
+		m.gpuPresence.update(gpus)
+		m.lastGPUs = gpus
 	}
 
-	gpuInfoLines := strings.Split(strings.TrimSpace(string(gpuInfoOutput)), "\n")
+	// Excluded GPUs produce no series; compute apps on them are skipped
+	// rather than counted as unmatched.
+	excludedUUIDs := make(map[string]struct{})
 	gpuUUIDToIndex := make(map[string]string)
-	for _, line := range gpuInfoLines {
-		parts := strings.Split(line, ", ")
-		if len(parts) == 4 {
-			uuid := parts[0]
-			index := parts[1]
-			gpuUUIDToIndex[uuid] = index
+	for _, gpu := range gpus {
+		if cfg.GPU.excludes(gpu["index"], gpu["gpu_uuid"]) {
+			excludedUUIDs[gpu["gpu_uuid"]] = struct{}{}
+			continue
+		}
+		gpuUUIDToIndex[gpu["gpu_uuid"]] = gpu["index"]
+		if cycle.devicesErr != nil {
+			continue
+		}
+		cycle.gpus = append(cycle.gpus, gpu)
+		if utilization, err := parsePercent(gpu["utilization.gpu"]); err == nil {
+			cycle.utilization[gpu["index"]] = utilization
 		}
 	}
 
-	// Initialize GPU metrics for all job IDs with "N/A"
-	for jobID := range jobIDs {
-		gpuUtilizationMetric.With(prometheus.Labels{"gpu_id": "N/A", "job_id": jobID}).Set(0)
-		gpuMemoryUsageMetric.With(prometheus.Labels{"gpu_id": "N/A", "job_id": jobID}).Set(0)
+	computeAppsOutput, err := queryComputeApps(ctx, cfg.GPU)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		cycle.appsErr = err
+		return cycle, nil
 	}
 
 	computeAppsLines := strings.Split(strings.TrimSpace(string(computeAppsOutput)), "\n")
+
+	// A compute app can be on a GPU the device query didn't return, e.g. one
+	// that appeared between the two nvidia-smi calls, so query once more.
+	for _, line := range computeAppsLines {
+		parts := strings.Split(line, ", ")
+		if len(parts) != 3 {
+			continue
+		}
+		if _, excluded := excludedUUIDs[parts[2]]; excluded {
+			continue
+		}
+		if _, exists := gpuUUIDToIndex[parts[2]]; !exists && cycle.devicesErr == nil {
+			if gpus, err := source.queryGPUs(ctx); err == nil {
+				for _, gpu := range validGPUs(gpus) {
+					if !cfg.GPU.excludes(gpu["index"], gpu["gpu_uuid"]) {
+						gpuUUIDToIndex[gpu["gpu_uuid"]] = gpu["index"]
+					}
+				}
+			}
+			break
+		}
+	}
+
+	for _, index := range gpuUUIDToIndex {
+		cycle.processes[index] = make(map[string]struct{})
+	}
+	for _, line := range computeAppsLines {
+		if parts := strings.Split(line, ", "); len(parts) == 3 {
+			if index, exists := gpuUUIDToIndex[parts[2]]; exists && cycle.processes[index] != nil {
+				cycle.processes[index][parts[0]] = struct{}{}
+			}
+		}
+	}
+
+	// Without running jobs no compute app can be attributed, unless they
+	// are reported as unmanaged. Without the job cgroups (nil jobs), no app
+	// can be told to be unmanaged either.
+	if len(cycle.jobIDs) == 0 && (cfg.GPU.UnmanagedJob == "" || jobs == nil) {
+		return cycle, nil
+	}
+
+	// gpu_utilization is device-wide, so on GPUs shared by several jobs
+	// job_gpu_utilization_percent splits it by the jobs' SM activity.
+	var processSM map[gpuPID]float64
+	if cfg.Collector.ProcessUtilization {
+		if processSM, err = queryProcessSMUtilization(ctx); err != nil && ctx.Err() == nil {
+			fmt.Printf("WARN: Failed to sample per-process GPU utilization, splitting it equally: %v\n", err)
+		}
+	}
+
+	// A PID that belongs to no job is expected; failing to read the cgroups
+	// is not, and fails the cycle once every compute app has been logged.
+	lookupFailures := 0
 	for _, line := range computeAppsLines {
 		parts := strings.Split(line, ", ")
 		if len(parts) == 3 {
 			pid := parts[0]
-			usedMemory, err := strconv.ParseFloat(strings.Trim(parts[1], " MiB"), 64)
+			usedMemory, err := parseMiB(parts[1])
 			if err != nil {
 				fmt.Printf("WARN: Error parsing used GPU memory for PID %s: %v\n", pid, err)
 				continue
 			}
 			uuid := parts[2]
+			if _, excluded := excludedUUIDs[uuid]; excluded {
+				continue
+			}
 
-			if index, exists := gpuUUIDToIndex[uuid]; exists {
-				jobID, err := getJobIDFromPID(pid)
-				if err != nil {
-					fmt.Printf("WARN: Error fetching job ID for PID %s: %v\n", pid, err)
+			index, exists := gpuUUIDToIndex[uuid]
+			if !exists {
+				// E.g. MIG instances, which have UUIDs of their own.
+				debugf("Compute app PID %s is on GPU %s, which the GPU query didn't return", pid, uuid)
+				m.unmatchedGPU.Inc()
+				continue
+			}
+
+			jobID, err := getJobIDFromPID(ctx, cfg, pid)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if errors.Is(err, ErrJobNotFound) {
+				debugf("Compute app PID %s doesn't belong to any job: %v", pid, err)
+				m.pidAttribution.WithLabelValues("not_found").Inc()
+				if cfg.GPU.UnmanagedJob == "" {
 					continue
 				}
+				// Reported like a job, so that the memory of all jobs adds up
+				// to the GPU's.
+				jobID = cfg.GPU.UnmanagedJob
+				cycle.jobIDs[jobID] = struct{}{}
+			} else if err != nil {
+				fmt.Printf("ERROR: Error fetching job ID for PID %s: %v\n", pid, err)
+				m.pidAttribution.WithLabelValues("error").Inc()
+				lookupFailures++
+				continue
+			}
 
-				if _, exists := jobIDs[jobID]; exists {
-					gpuMemoryUsageMetric.With(prometheus.Labels{"gpu_id": index, "job_id": jobID}).Set(usedMemory * 1024 * 1024)
-					gpuUtilizationMetric.With(prometheus.Labels{"gpu_id": index, "job_id": jobID}).Set(0) // Replace 0 with actual utilization value if available
+			if _, exists := cycle.jobIDs[jobID]; exists {
+				cycle.jobMemory[gpuJob{gpuID: index, jobID: jobID}] += usedMemory
+				if cycle.jobSM[index] == nil {
+					cycle.jobSM[index] = make(map[string]float64)
 				}
+				cycle.jobSM[index][jobID] += processSM[gpuPID{gpuID: index, pid: pid}]
 			}
 		}
 	}
+	if lookupFailures > 0 {
+		cycle.appsErr = fmt.Errorf("failed to look up the job of %d compute apps", lookupFailures)
+		return cycle, nil
+	}
+
+	// A GPU allocated to a job that runs nothing on it shows up in neither
+	// compute app, so report it as idle to make wasted allocations visible.
+	// Only Slurm keeps the allocation in a devices cgroup.
+	if cfg.Workload.Manager != "slurm" {
+		return cycle, nil
+	}
+	minorUUIDs, err := gpuMinorUUIDs()
+	if err != nil {
+		fmt.Printf("WARN: Failed to map GPU minor numbers to UUIDs: %v\n", err)
+	}
+	for _, job := range jobs {
+		minors, err := jobGPUMinors(cfg, job)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Without ConstrainDevices=yes no job has one, so logging it
+			// for every job would only repeat the same thing.
+			if !m.devicesListMissingLogged {
+				fmt.Printf("WARN: No devices.list for job %s, GPU allocations are only reported for jobs whose devices Slurm constrains: %v\n", job.ID, err)
+				m.devicesListMissingLogged = true
+			}
+			continue
+		}
+		if err != nil {
+			fmt.Printf("WARN: Failed to read the GPU allocation of job %s: %v\n", job.ID, err)
+			continue
+		}
+		for _, minor := range minors {
+			index, exists := gpuUUIDToIndex[minorUUIDs[minor]]
+			if !exists {
+				continue
+			}
+			key := gpuJob{gpuID: index, jobID: job.ID}
+			cycle.allocated[key] = struct{}{}
+			if _, busy := cycle.jobMemory[key]; !busy && !cfg.GPU.OnlyActive {
+				cycle.idle[key] = struct{}{}
+			}
+		}
+	}
+
+	return cycle, nil
 }
 
-func collectIOMetrics() map[string]struct{} {
-	jobIDs := make(map[string]struct{})
+// apply sets the GPU metrics from the parts of the cycle that were read, and
+// deletes the series of the jobs that ended since the previous one.
+func (c *gpuCycle) apply(m *exporterMetrics) {
+	if c.devicesErr == nil {
+		c.applyDevices(m)
+	}
+	if c.appsErr == nil {
+		c.applyJobs(m)
+	}
+}
 
-	basePath := "/sys/fs/cgroup/cpu/slurm"
+// applyDevices sets the device-level metrics of every GPU.
+func (c *gpuCycle) applyDevices(m *exporterMetrics) {
+	m.nodeGPU.update(c.gpus, c.utilization)
+	if m.topology != nil {
+		m.topology.setGPUs(c.gpus)
+	}
+	if m.gpuThrottle != nil {
+		m.gpuThrottle.update(c.gpus, m.clock.Now())
+	}
 
-	baseDir, err := os.Open(basePath)
-	if err != nil {
-		fmt.Printf("Failed to open the base directory: %s\n", err)
-		return nil
+	for _, gpu := range c.gpus {
+		index := gpu["index"]
+
+		// GPUs with ECC disabled report [N/A], so their series are omitted.
+		// The same goes for fields a GPU source doesn't provide at all.
+		for errorType, field := range gpuEccFields {
+			if count, err := strconv.ParseFloat(gpu[field], 64); err == nil {
+				m.gpuEccErrors.Set(prometheus.Labels{"gpu_id": index, "type": errorType}, count)
+			}
+		}
+
+		if m.onlyActive && !c.active(index) {
+			c.deleteUsage(m, index)
+		} else {
+			c.setUsage(m, gpu)
+		}
+
+		setGPUModeInfo(m.gpuComputeMode, index, gpu["compute_mode"])
+		setGPUModeInfo(m.gpuPersistenceMode, index, gpu["persistence_mode"])
 	}
-	defer baseDir.Close()
+}
 
-	entries, err := baseDir.Readdirnames(-1)
-	if err != nil {
-		fmt.Printf("Failed to read the entries in the directory: %s\n", err)
-		return nil
+// active reports whether the GPU of the given index is in use: it has compute
+// apps or a nonzero utilization, or either is unknown.
+func (c *gpuCycle) active(index string) bool {
+	utilization, ok := c.utilization[index]
+	return !ok || utilization != 0 || c.appsErr != nil || len(c.processes[index]) > 0
+}
+
+// setUsage sets the per-GPU gauges of gpu.
+func (c *gpuCycle) setUsage(m *exporterMetrics, gpu gpuInfo) {
+	labels := prometheus.Labels{"gpu_id": gpu["index"]}
+	// Unsupported fields report [N/A], e.g. the fan speed of passively
+	// cooled GPUs, so their series are omitted.
+	for field, metric := range m.gpuGauges {
+		if value, err := gpuGaugeFields[field].parse(gpu[field]); err == nil {
+			metric.With(labels).Set(value)
+		}
 	}
+	for field, metric := range m.gpuProfiling {
+		if ratio, err := strconv.ParseFloat(gpu[field], 64); err == nil {
+			metric.With(labels).Set(ratio)
+		}
+	}
+	for field, metric := range m.gpuBAR1 {
+		if value, err := parseMiB(gpu[field]); err == nil {
+			metric.With(labels).Set(value)
+		}
+	}
+}
+
+// deleteUsage deletes the per-GPU gauges of the GPU of the given index, for
+// -gpu.only-active.
+func (c *gpuCycle) deleteUsage(m *exporterMetrics, index string) {
+	labels := prometheus.Labels{"gpu_id": index}
+	for _, metric := range m.gpuGauges {
+		metric.Delete(labels)
+	}
+	for _, metric := range m.gpuProfiling {
+		metric.Delete(labels)
+	}
+	for _, metric := range m.gpuBAR1 {
+		metric.Delete(labels)
+	}
+}
 
-	for _, entry := range entries {
-		if strings.HasPrefix(entry, "uid_") {
-			uidPath := fmt.Sprintf("%s/%s", basePath, entry)
+// applyJobs sets the metrics of the compute apps and the jobs they belong to.
+// Without the device query, the device utilization they are labeled with is
+// unknown, so those series keep their previous values.
+func (c *gpuCycle) applyJobs(m *exporterMetrics) {
+	for index, pids := range c.processes {
+		m.gpuProcessCount.WithLabelValues(index).Set(float64(len(pids)))
+	}
 
-			uidDir, err := os.Open(uidPath)
-			if err != nil {
-				fmt.Printf("Failed to open UID directory %s: %s\n", uidPath, err)
+	// Drop the series of the jobs that ended since the last cycle, so that
+	// they don't keep exporting their last values.
+	for jobID := range m.gpuJobIDs {
+		if _, exists := c.jobIDs[jobID]; !exists {
+			labels := prometheus.Labels{"job_id": jobID}
+			m.gpuUtilization.DeletePartialMatch(labels)
+			m.jobGPUUtilization.DeletePartialMatch(labels)
+			m.gpuMemoryUsage.DeletePartialMatch(labels)
+			m.jobGPUMemoryUsage.Delete(labels)
+			m.jobGPUMemoryMax.DeletePartialMatch(labels)
+			m.jobGPUCount.Delete(labels)
+			delete(m.gpuMemoryPeaks, jobID)
+		}
+	}
+	m.gpuJobIDs = c.jobIDs
+
+	for key := range m.gpuAllocations {
+		if _, exists := c.allocated[key]; !exists {
+			m.jobGPUAllocatedIndex.Delete(prometheus.Labels{"gpu_id": key.gpuID, "job_id": key.jobID})
+		}
+	}
+	for key := range c.allocated {
+		m.jobGPUAllocatedIndex.Set(prometheus.Labels{"gpu_id": key.gpuID, "job_id": key.jobID}, 1)
+	}
+	m.gpuAllocations = c.allocated
+
+	jobGPUs := make(map[string]map[string]struct{})
+	addJobGPU := func(key gpuJob) {
+		if jobGPUs[key.jobID] == nil {
+			jobGPUs[key.jobID] = make(map[string]struct{})
+		}
+		jobGPUs[key.jobID][key.gpuID] = struct{}{}
+	}
+
+	for key := range c.idle {
+		labels := prometheus.Labels{"gpu_id": key.gpuID, "job_id": key.jobID}
+		m.gpuMemoryUsage.Set(labels, 0)
+		m.gpuUtilization.Set(labels, 0)
+		m.jobGPUUtilization.Set(labels, 0)
+		addJobGPU(key)
+	}
+
+	jobTotalMemory := make(map[string]float64, len(c.jobIDs))
+	jobGPUCount := make(map[string]float64, len(c.jobIDs))
+	for jobID := range c.jobIDs {
+		jobTotalMemory[jobID] = 0
+		jobGPUCount[jobID] = 0
+	}
+	for key, memory := range c.jobMemory {
+		jobGPUCount[key.jobID]++
+		m.gpuMemoryUsage.Set(prometheus.Labels{"gpu_id": key.gpuID, "job_id": key.jobID}, memory)
+		if c.devicesErr == nil {
+			m.gpuUtilization.Set(prometheus.Labels{"gpu_id": key.gpuID, "job_id": key.jobID}, c.utilization[key.gpuID])
+		}
+		addJobGPU(key)
+		jobTotalMemory[key.jobID] += memory
+
+		peaks := m.gpuMemoryPeaks[key.jobID]
+		if peaks == nil {
+			peaks = make(map[string]float64)
+			m.gpuMemoryPeaks[key.jobID] = peaks
+		}
+		if peak, seen := peaks[key.gpuID]; !seen || memory > peak {
+			peaks[key.gpuID] = memory
+			m.jobGPUMemoryMax.Set(prometheus.Labels{"gpu_id": key.gpuID, "job_id": key.jobID}, memory)
+		}
+	}
+	for jobID, memory := range jobTotalMemory {
+		m.jobGPUMemoryUsage.Set(prometheus.Labels{"job_id": jobID}, memory)
+		m.jobGPUCount.Set(prometheus.Labels{"job_id": jobID}, jobGPUCount[jobID])
+	}
+	if c.devicesErr == nil {
+		jobShares := make(map[string]float64)
+		for gpuID, sm := range c.jobSM {
+			for jobID, share := range attributeGPUUtilization(c.utilization[gpuID], sm) {
+				m.jobGPUUtilization.Set(prometheus.Labels{"gpu_id": gpuID, "job_id": jobID}, share)
+				jobShares[jobID] += share
+			}
+		}
+		m.jobGPUSeconds.update(c.jobIDs, jobShares, m.clock.Now())
+	}
+	m.jobs.update(c.jobs, jobGPUs)
+}
+
+// setGPUModeInfo sets the info-style metric for a GPU to 1 with mode as its
+// label, replacing the series for the GPU's previous mode.
+func setGPUModeInfo(metric *prometheus.GaugeVec, index, mode string) {
+	metric.DeletePartialMatch(prometheus.Labels{"gpu_id": index})
+	if mode != "" && mode != "[N/A]" {
+		metric.With(prometheus.Labels{"gpu_id": index, "mode": mode}).Set(1)
+	}
+}
+
+// slurmJob is a Slurm job discovered in the cgroup hierarchy, or a pod with
+// -workload.manager=kubernetes, in which case ID is the pod UID and UID is
+// empty. Dir is its cgroup directory.
+type slurmJob struct {
+	ID   string
+	UID  string
+	Dir  string
+	PIDs []string
+	// Threads is the number of threads of the processes in PIDs.
+	Threads int
+}
+
+// walkJobs lists the jobs of the configured workload manager. The list is not
+// nil even if there is no job, which the GPU collector tells apart from the
+// job cgroups being unavailable.
+func walkJobs(ctx context.Context, cfg *Config) ([]slurmJob, error) {
+	var jobs []slurmJob
+	var err error
+	if cfg.Workload.Manager == "kubernetes" {
+		jobs, err = walkKubernetesPods(ctx)
+	} else {
+		jobs, err = walkSlurmJobs(ctx, cfg)
+	}
+	if err == nil && jobs == nil {
+		jobs = []slurmJob{}
+	}
+	return jobs, err
+}
+
+// walkSlurmJobs lists the jobs under every root of -cgroup.slurm-paths. A job
+// found under several of them, e.g. in both a cpu and a systemd hierarchy, is
+// listed once, in the first root, with the PIDs found in all of them. Roots
+// that don't exist are skipped, unless none does.
+func walkSlurmJobs(ctx context.Context, cfg *Config) ([]slurmJob, error) {
+	var jobs []slurmJob
+	jobIndex := make(map[string]int)
+	found := false
+	for _, root := range cfg.Cgroup.SlurmPaths {
+		rootJobs, err := walkSlurmRoot(ctx, cfg, hostPath(root))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = true
+
+		for _, job := range rootJobs {
+			i, seen := jobIndex[job.ID]
+			if !seen {
+				jobIndex[job.ID] = len(jobs)
+				jobs = append(jobs, job)
 				continue
 			}
+			for _, pid := range job.PIDs {
+				if !stringList(jobs[i].PIDs).contains(pid) {
+					jobs[i].PIDs = append(jobs[i].PIDs, pid)
+				}
+			}
+			// The hierarchies hold the same processes.
+			jobs[i].Threads = max(jobs[i].Threads, job.Threads)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("none of %s exists", strings.Join(cfg.Cgroup.SlurmPaths, ", "))
+	}
+	return jobs, nil
+}
+
+// walkSlurmRoot lists every job under the Slurm cgroup root basePath together
+// with the PIDs found in the cgroup.procs of its directory and of those of
+// its steps. Jobs with no PIDs are still returned. Directories whose IDs
+// give the same job_id, e.g. those bucketed under -label.invalid-job-id or
+// the tasks of an array with -label.job-id-strip-array-task, are listed as
+// one job, with the PIDs and threads of all of them and the directory of
+// the first.
+func walkSlurmRoot(ctx context.Context, cfg *Config, basePath string) ([]slurmJob, error) {
+	dirs, err := findSlurmJobDirs(ctx, cfg.Cgroup.slurmJobPatterns, basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []slurmJob
+	jobIndex := make(map[string]int)
+	for _, dir := range dirs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if dir.uid != "" && !cfg.Slurm.walksUID(dir.uid) {
+			continue
+		}
+		jobID, ok := cfg.Label.jobID(dir.rawID)
+		if !ok {
+			continue
+		}
+		job := slurmJob{ID: jobID, UID: dir.uid, Dir: dir.path}
+
+		pids, threads, err := readCgroupTree(dir.path)
+		switch {
+		case os.IsNotExist(err):
+			fmt.Printf("WARN: No cgroup.procs file for job %s in %s, skipping\n", dir.rawID, dir.path)
+		case err != nil:
+			fmt.Printf("WARN: Failed to read the PIDs of job %s in %s: %v\n", dir.rawID, dir.path, err)
+		case len(pids) == 0:
+			fmt.Printf("WARN: No PIDs found in the cgroups of job %s in %s, skipping\n", dir.rawID, dir.path)
+		default:
+			job.PIDs = pids
+			job.Threads = threads
+		}
+
+		// The cgroup v2 layouts don't name the owner of the job, which is
+		// then that of its processes.
+		if dir.uid == "" && len(job.PIDs) > 0 {
+			job.UID = processUID(job.PIDs[0])
+		}
+		if dir.uid == "" && !cfg.Slurm.walksUID(job.UID) {
+			continue
+		}
+		if i, seen := jobIndex[job.ID]; seen {
+			// Each directory holds processes of its own.
+			jobs[i].PIDs = append(jobs[i].PIDs, job.PIDs...)
+			jobs[i].Threads += job.Threads
+			continue
+		}
+		jobIndex[job.ID] = len(jobs)
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+// countCgroupThreads returns the number of threads in the cgroup directory
+// dir, from cgroup.threads on cgroup v2 or tasks on cgroup v1, or 0 if it
+// lists none or can't be read, e.g. because the job just ended.
+func countCgroupThreads(dir string) int {
+	for _, name := range []string{"cgroup.threads", "tasks"} {
+		if tids, err := os.ReadFile(filepath.Join(dir, name)); err == nil {
+			return len(strings.Fields(string(tids)))
+		}
+	}
+	return 0
+}
+
+// setJobShape sets the process and thread count and the state of every job,
+// and deletes the series of jobs that ended.
+func (m *exporterMetrics) setJobShape(jobs []slurmJob) {
+	current := slurmJobIDs(jobs)
+	states := make(map[string]string, len(jobs))
+	for jobID := range m.shapeJobIDs {
+		if _, exists := current[jobID]; !exists {
+			m.jobProcessCount.Delete(prometheus.Labels{"job_id": jobID})
+			m.jobThreadCount.Delete(prometheus.Labels{"job_id": jobID})
+			m.jobState.DeletePartialMatch(prometheus.Labels{"job_id": jobID})
+		}
+	}
+	for _, job := range jobs {
+		m.jobProcessCount.Set(prometheus.Labels{"job_id": job.ID}, float64(len(job.PIDs)))
+		m.jobThreadCount.Set(prometheus.Labels{"job_id": job.ID}, float64(job.Threads))
+
+		state := jobState(job)
+		if m.jobStates[job.ID] != state {
+			m.jobState.DeletePartialMatch(prometheus.Labels{"job_id": job.ID})
+		}
+		m.jobState.Set(prometheus.Labels{"job_id": job.ID, "state": state}, 1)
+		states[job.ID] = state
+	}
+	m.jobStates = states
+	m.shapeJobIDs = current
+}
+
+// setPIDIOTotals sets the pid-labeled IO metrics to the totals of each
+// process, and deletes the series of processes that couldn't be read, e.g.
+// because they exited, so that PID churn frees room under the series limit.
+func (m *exporterMetrics) setPIDIOTotals(totals map[pidJob]ioTotals) {
+	for key := range m.ioPIDs {
+		if _, exists := totals[key]; !exists {
+			labels := prometheus.Labels{"pid": key.pid, "job_id": key.jobID}
+			if m.ioReadBytes != nil {
+				m.ioReadBytes.Delete(labels)
+				m.ioWriteBytes.Delete(labels)
+			}
+			if m.legacyIOReadBytes != nil {
+				m.legacyIOReadBytes.Delete(labels)
+				m.legacyIOWriteBytes.Delete(labels)
+			}
+			delete(m.ioPIDs, key)
+		}
+	}
+	for key, total := range totals {
+		labels := prometheus.Labels{"pid": key.pid, "job_id": key.jobID}
+		if m.ioReadBytes != nil {
+			m.ioReadBytes.Set(labels, total.read)
+			m.ioWriteBytes.Set(labels, total.write)
+		}
+		if m.legacyIOReadBytes != nil {
+			m.legacyIOReadBytes.Set(labels, total.read)
+			m.legacyIOWriteBytes.Set(labels, total.write)
+		}
+		m.ioPIDs[key] = struct{}{}
+	}
+}
+
+// setJobIOTotals sets the job-level IO metrics to the totals summed over each
+// job's processes, and deletes the series of jobs none of whose processes
+// could be read, e.g. because they ended.
+func (m *exporterMetrics) setJobIOTotals(totals map[pidJob]ioTotals) {
+	jobTotals := make(map[string]ioTotals)
+	for key, total := range totals {
+		sum := jobTotals[key.jobID]
+		jobTotals[key.jobID] = ioTotals{read: sum.read + total.read, write: sum.write + total.write}
+	}
+
+	for jobID := range m.ioJobIDs {
+		if _, exists := jobTotals[jobID]; !exists {
+			m.jobIOReadBytes.Delete(prometheus.Labels{"job_id": jobID})
+			m.jobIOWriteBytes.Delete(prometheus.Labels{"job_id": jobID})
+			delete(m.ioJobIDs, jobID)
+		}
+	}
+	for jobID, total := range jobTotals {
+		m.jobIOReadBytes.Set(prometheus.Labels{"job_id": jobID}, total.read)
+		m.jobIOWriteBytes.Set(prometheus.Labels{"job_id": jobID}, total.write)
+		m.ioJobIDs[jobID] = struct{}{}
+	}
+}
+
+// readProcIO returns the read_bytes and write_bytes counters from
+// /proc/<pid>/io. Counters missing from the file are reported as 0.
+func readProcIO(pid string) (float64, float64, error) {
+	content, err := os.ReadFile(hostPath(fmt.Sprintf("/proc/%s/io", pid)))
+	if err != nil {
+		return 0, 0, err
+	}
 
-			jobEntries, err := uidDir.Readdirnames(-1)
-			uidDir.Close()
+	var readBytes, writeBytes float64
+	for _, line := range strings.Split(string(content), "\n") {
+		parts := strings.Split(line, ":")
+		if len(parts) == 2 {
+			key := strings.TrimSpace(parts[0])
+			value, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
 			if err != nil {
-				fmt.Printf("Failed to read job entries in UID directory %s: %s\n", uidPath, err)
+				fmt.Printf("WARN: Error parsing IO metric for PID %s: %v\n", pid, err)
 				continue
 			}
 
-			for _, jobEntry := range jobEntries {
-				if strings.HasPrefix(jobEntry, "job_") {
-					jobID := strings.TrimPrefix(jobEntry, "job_")
-					jobIDs[jobID] = struct{}{}
+			if key == "read_bytes" {
+				readBytes = value
+			} else if key == "write_bytes" {
+				writeBytes = value
+			}
+		}
+	}
 
-					jobPath := fmt.Sprintf("%s/%s", uidPath, jobEntry)
-					cgroupProcsPath := filepath.Join(jobPath, "cgroup.procs")
+	return readBytes, writeBytes, nil
+}
 
-					if _, err := os.Stat(cgroupProcsPath); os.IsNotExist(err) {
-						fmt.Printf("WARN: No cgroup.procs file for job %s (UID %s), skipping\n", jobEntry, entry)
-						continue
-					}
+// userHZ is the unit of the times in /proc/<pid>/stat, USER_HZ, which is 100
+// on every architecture Linux runs on in practice.
+const userHZ = 100
 
-					pids, err := os.ReadFile(cgroupProcsPath)
-					if err != nil {
-						fmt.Printf("WARN: Failed to read cgroup.procs for job %s (UID %s): %v\n", jobEntry, entry, err)
-						continue
-					}
+// readUptime returns the time since boot from /proc/uptime.
+func readUptime() (time.Duration, error) {
+	content, err := os.ReadFile(hostPath("/proc/uptime"))
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("empty /proc/uptime")
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse /proc/uptime: %v", err)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
 
-					if len(strings.Fields(string(pids))) == 0 {
-						fmt.Printf("WARN: No PIDs found in cgroup.procs for job %s (UID %s), skipping\n", jobEntry, entry)
-						continue
-					}
+// readProcessAge returns how long pid has been running, given the uptime of
+// the node, from the starttime field of /proc/<pid>/stat.
+func readProcessAge(pid string, uptime time.Duration) (time.Duration, error) {
+	fields, err := readProcStat(pid)
+	if err != nil {
+		return 0, err
+	}
+	// starttime is field 22.
+	ticks, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse the start time of PID %s: %v", pid, err)
+	}
+	return uptime - time.Duration(ticks)*time.Second/userHZ, nil
+}
 
-					for _, pid := range strings.Fields(string(pids)) {
-						ioFilePath := fmt.Sprintf("/proc/%s/io", pid)
-						content, err := os.ReadFile(ioFilePath)
-						if err != nil {
-							fmt.Printf("Error reading IO file for PID %s: %v\n", pid, err)
-							ioReadBytesMetric.With(prometheus.Labels{"pid": pid, "job_id": jobID}).Set(0)
-							ioWriteBytesMetric.With(prometheus.Labels{"pid": pid, "job_id": jobID}).Set(0)
-							continue
-						}
-
-						ioReadSet := false
-						ioWriteSet := false
-						for _, line := range strings.Split(string(content), "\n") {
-							parts := strings.Split(line, ":")
-							if len(parts) == 2 {
-								key := strings.TrimSpace(parts[0])
-								value, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
-								if err != nil {
-									fmt.Printf("WARN: Error parsing IO metric for PID %s: %v\n", pid, err)
-									continue
-								}
-
-								if key == "read_bytes" {
-									ioReadBytesMetric.With(prometheus.Labels{"pid": pid, "job_id": jobID}).Set(value)
-									ioReadSet = true
-								} else if key == "write_bytes" {
-									ioWriteBytesMetric.With(prometheus.Labels{"pid": pid, "job_id": jobID}).Set(value)
-									ioWriteSet = true
-								}
-							}
-						}
-
-						if !ioReadSet {
-							ioReadBytesMetric.With(prometheus.Labels{"pid": pid, "job_id": jobID}).Set(0)
-						}
-						if !ioWriteSet {
-							ioWriteBytesMetric.With(prometheus.Labels{"pid": pid, "job_id": jobID}).Set(0)
-						}
-					}
-				}
+// readProcStat returns the fields of /proc/<pid>/stat from the state, field
+// 3, on. The command name in parentheses before it may contain spaces, so
+// fields are counted from the last closing parenthesis.
+func readProcStat(pid string) ([]string, error) {
+	content, err := os.ReadFile(hostPath(fmt.Sprintf("/proc/%s/stat", pid)))
+	if err != nil {
+		return nil, err
+	}
+	stat := string(content)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	if len(fields) < 20 {
+		return nil, fmt.Errorf("malformed stat file of PID %s", pid)
+	}
+	return fields, nil
+}
+
+// jobState returns "suspended" if every process of job is stopped, as Slurm
+// leaves them with SIGSTOP when it suspends or gang-schedules the job out,
+// and "running" otherwise, including for jobs without processes. Processes
+// that exited or whose state can't be read don't count as stopped.
+func jobState(job slurmJob) string {
+	if len(job.PIDs) == 0 {
+		return "running"
+	}
+	// Running jobs are told apart by their first running process, so they
+	// cost a single read in the common case.
+	for _, pid := range job.PIDs {
+		fields, err := readProcStat(pid)
+		if err != nil || fields[0] != "T" {
+			return "running"
+		}
+	}
+	return "suspended"
+}
+
+// processExited reports whether err means the process went away between
+// being listed in cgroup.procs and having its /proc entry read.
+func processExited(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ESRCH)
+}
+
+// collectIOMetrics walks the Slurm cgroup hierarchy, sets the IO metrics of
+// every job's processes and returns the jobs it found.
+func collectIOMetrics(ctx context.Context, cfg *Config, m *exporterMetrics) ([]slurmJob, error) {
+	// Timed separately so that a slow cgroup filesystem can be told from a
+	// slow /proc.
+	start := m.clock.Now()
+	jobs, err := walkJobs(ctx, cfg)
+	m.cgroupWalk.Set(m.clock.Now().Sub(start).Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk the %s cgroup hierarchy: %v", cfg.Workload.Manager, err)
+	}
+	m.setJobShape(jobs)
+
+	// Build the unique PID set first so each /proc/<pid>/io is read once per
+	// cycle, even if a PID shows up in more than one job's cgroup.
+	pidJobs := make(map[string][]string)
+	if m.procIO {
+		for _, job := range jobs {
+			for _, pid := range job.PIDs {
+				pidJobs[pid] = append(pidJobs[pid], job.ID)
 			}
 		}
 	}
 
+	var uptime time.Duration
+	if cfg.IO.MinPIDAge > 0 && len(pidJobs) > 0 {
+		if uptime, err = readUptime(); err != nil {
+			return nil, fmt.Errorf("failed to read the uptime: %v", err)
+		}
+	}
+
+	// The totals are only applied once every PID has been read.
+	totals := make(map[pidJob]ioTotals)
+	pids := make([]string, 0, len(pidJobs))
+	for pid := range pidJobs {
+		pids = append(pids, pid)
+	}
+	err = readPIDIOs(ctx, pids, cfg.IO.ReadConcurrency, cfg.IO.MinPIDAge, uptime, func(result pidIO) error {
+		if processExited(result.err) {
+			return nil
+		}
+		// Reading other users' IO counters needs privileges, so without
+		// them every PID of every cycle would be logged.
+		if errors.Is(result.err, fs.ErrPermission) {
+			m.ioPermissionDenied.Inc()
+			if _, logged := m.ioDeniedPIDs[result.pid]; !logged {
+				fmt.Printf("WARN: Permission denied reading IO file for PID %s, see the README for the required privileges\n", result.pid)
+				m.ioDeniedPIDs[result.pid] = struct{}{}
+			}
+			return nil
+		}
+		if result.err != nil {
+			// Keep the previous cycle's values rather than exporting a
+			// partial update.
+			return result.err
+		}
+		if result.young {
+			return nil
+		}
+		for _, jobID := range pidJobs[result.pid] {
+			totals[pidJob{pid: result.pid, jobID: jobID}] = result.totals
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m.setPIDIOTotals(totals)
+	if m.jobIOReadBytes != nil {
+		m.setJobIOTotals(totals)
+	}
+	m.ioRate.update(totals, m.clock.Now())
+	if m.nodeIO != nil {
+		m.nodeIO.update(totals)
+	}
+
+	for pid := range m.ioDeniedPIDs {
+		if _, exists := pidJobs[pid]; !exists {
+			delete(m.ioDeniedPIDs, pid)
+		}
+	}
+
+	return jobs, nil
+}
+
+// pidIO is the outcome of reading the IO of one PID.
+type pidIO struct {
+	pid    string
+	totals ioTotals
+	young  bool // younger than -io.min-pid-age, so not read
+	err    error
+}
+
+// readPIDIO reads the IO totals of pid, unless it is younger than minAge.
+func readPIDIO(pid string, minAge, uptime time.Duration) pidIO {
+	result := pidIO{pid: pid}
+	if minAge > 0 {
+		age, err := readProcessAge(pid, uptime)
+		if err != nil {
+			result.err = err
+			return result
+		}
+		if age < minAge {
+			result.young = true
+			return result
+		}
+	}
+	readBytes, writeBytes, err := readProcIO(pid)
+	if err != nil {
+		result.err = fmt.Errorf("failed to read the IO file of PID %s: %w", pid, err)
+		return result
+	}
+	result.totals = ioTotals{read: readBytes, write: writeBytes}
+	return result
+}
+
+// readPIDIOs reads the IO of pids with up to concurrency reads at a time, as
+// jobs can have thousands of processes and every read is a syscall round trip
+// through procfs. handle is called with each result from the calling
+// goroutine, so it needs no locking; the first error it returns stops the
+// reads and is returned.
+func readPIDIOs(ctx context.Context, pids []string, concurrency int, minAge, uptime time.Duration, handle func(pidIO) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	queue := make(chan string)
+	go func() {
+		defer close(queue)
+		for _, pid := range pids {
+			select {
+			case queue <- pid:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	results := make(chan pidIO)
+	var workers sync.WaitGroup
+	for i := 0; i < min(concurrency, len(pids)); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for pid := range queue {
+				results <- readPIDIO(pid, minAge, uptime)
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	// Drain the results even after an error, so that no worker is left
+	// blocked sending one.
+	var err error
+	for result := range results {
+		if err == nil {
+			if err = handle(result); err != nil {
+				cancel()
+			}
+		}
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
+// slurmJobIDs returns the set of IDs of jobs.
+func slurmJobIDs(jobs []slurmJob) map[string]struct{} {
+	jobIDs := make(map[string]struct{}, len(jobs))
+	for _, job := range jobs {
+		jobIDs[job.ID] = struct{}{}
+	}
 	return jobIDs
 }
 
-func main() {
+// runCollector calls collect and records the outcome of the cycle, reporting
+// whether it succeeded. Panics are recovered so that one bad cycle (e.g.
+// malformed nvidia-smi output) doesn't stop collection for good.
+func runCollector(ctx context.Context, m *exporterMetrics, name string, collect func() error) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("ERROR: %s collector panicked: %v\n%s", name, r, debug.Stack())
+			m.collectionErrors.WithLabelValues(name).Inc()
+			m.errors.add(m.clock.Now(), name, fmt.Sprintf("panic: %v", r))
+			ok = false
+		}
+	}()
+
+	if err := collect(); err != nil {
+		// Errors caused by shutdown interrupting the cycle aren't failures.
+		if ctx.Err() == nil {
+			fmt.Printf("WARN: %s collection failed: %s\n", name, err)
+			m.collectionErrors.WithLabelValues(name).Inc()
+			m.errors.add(m.clock.Now(), name, err.Error())
+		}
+		return false
+	}
+
+	m.lastCollection.WithLabelValues(name).Set(float64(m.clock.Now().Unix()))
+	return true
+}
+
+// runEvery calls collect every interval of clk until ctx is cancelled.
+func runEvery(ctx context.Context, clk clock, interval time.Duration, collect func()) {
+	ticker := clk.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			collect()
+		}
+	}
+}
+
+// collectionJitter returns a delay in [0, max). It is random across nodes but
+// reproducible for a given node, as the random source is seeded with the
+// hostname.
+func collectionJitter(max time.Duration) time.Duration {
+	hostname, _ := os.Hostname()
+	seed := fnv.New64a()
+	seed.Write([]byte(hostname))
+	return time.Duration(rand.New(rand.NewSource(int64(seed.Sum64()))).Int63n(int64(max)))
+}
+
+// startCollection starts the GPU source and the collection loops, which run
+// until ctx is cancelled, or with -scrape-mode=scrape collects on each
+// gather instead. It returns the gatherer of the collected metrics and a
+// function that runs one last cycle once the loops have stopped. jobs, if
+// not nil, receives the jobs of every GPU cycle, and errs the errors of
+// failed cycles.
+func startCollection(ctx context.Context, cfg *Config, jobs *jobSnapshot, errs *errorLog) (prometheus.Gatherer, func(context.Context)) {
+	metrics := newExporterMetrics(cfg.Metrics, cfg.GPU, cfg.Label.extra)
+	metrics.jobs = jobs
+	metrics.errors = errs
+	// The exporter's own footprint, which the default registry would have
+	// exposed.
+	register(metrics.registerer,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	var source gpuSource = newSMIQuerySource(gpuQueryFields(cfg.GPU.Query))
+	switch {
+	case cfg.GPU.FixtureFile != "":
+		source = newFixtureSource(cfg.GPU.FixtureFile)
+	case cfg.GPU.Backend == "dcgm":
+		dcgm := newDCGMSource(cfg.GPU.DCGMHost)
+		go dcgm.run(ctx)
+		source = dcgm
+	case cfg.GPU.Mode == "dmon":
+		dmon := newDmonSource()
+		go dmon.run(ctx)
+		source = dmon
+	}
+
+	if len(cfg.GPU.Exclude) > 0 {
+		warnUnknownExcludedGPUs(ctx, cfg.GPU.Exclude)
+	}
+	driver := newGPUDriverInfo(metrics.registerer)
+
+	var accounting *gpuAccounting
+	if cfg.Collector.GPUAccounting {
+		if err := enableGPUAccounting(ctx); err != nil {
+			fmt.Printf("WARN: Failed to enable GPU accounting mode, it must be enabled beforehand: %v\n", err)
+		}
+		accounting = newGPUAccounting(metrics.registerer, cfg.GPU)
+	}
+
+	var network *networkCollector
+	if cfg.Collector.Network {
+		network = newNetworkCollector(metrics.registerer, cfg.Metrics.MaxSeries, metrics.droppedSeries)
+	}
+
+	// With the cgroup source, the io.stat collector replaces the reads of
+	// /proc/<pid>/io rather than adding to them.
+	ioSource := resolveIOSource(cfg.IO.Source)
+	metrics.procIO = ioSource == "proc"
+	if metrics.procIO {
+		metrics.nodeIO = newNodeIO(metrics.registerer)
+	}
+	ioSourceInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "job_exporter_io_source",
+		Help: "Always 1, labeled with where the IO of jobs is read from: proc (/proc/<pid>/io) or cgroup (cgroup v2 io.stat).",
+	}, []string{"source"})
+	ioSourceInfo.WithLabelValues(ioSource).Set(1)
+	register(metrics.registerer, ioSourceInfo)
+	switch {
+	case cfg.IO.Source == "auto":
+		debugf("Reading IO from %s", ioSource)
+	case ioSource == "cgroup" && !ioControllerAvailable():
+		fmt.Printf("WARN: The cgroup v2 io controller is not available, no job IO will be reported with -io.source=cgroup\n")
+	}
+
+	var ioStat *ioStatCollector
+	if cfg.Collector.IOStat || ioSource == "cgroup" {
+		ioStat = newIOStatCollector(metrics.registerer, cfg.Workload.Manager, cfg.Collector.IOStatDevices, cfg.Metrics.MaxSeries, metrics.droppedSeries)
+	}
+
+	var oomKills *oomCollector
+	if cfg.Collector.OOMKills {
+		oomKills = newOOMCollector(metrics.registerer, cfg.Workload.Manager)
+	}
+
+	var scratch *scratchCollector
+	if cfg.Scratch.Path != "" {
+		scratch = newScratchCollector(metrics.registerer, cfg.Scratch, cfg.Metrics.MaxSeries, metrics.droppedSeries)
+	}
+
+	var metadataCache *jobMetadataCache
+	var jobInfo *jobInfoVec
+	var jobGPUAllocated *prometheus.GaugeVec
+	if cfg.Slurm.Enrich {
+		metadataCache = newJobMetadataCache(cfg.Slurm.EnrichTTL)
+		jobInfo = newJobInfoVec(cfg.Label.Keep, cfg.Label.Drop)
+		jobGPUAllocated = newJobGPUAllocatedVec()
+		register(metrics.registerer, jobInfo, jobGPUAllocated)
+	}
+	runtimes := newJobRuntime(metrics.registerer, metrics.clock, metadataCache, cfg.Label.InvalidJobID)
+
+	// GPU utilization is bursty and cheap to sample, while the cgroup walk
+	// is expensive, so each runs on its own ticker. GPU cycles attribute
+	// compute apps to the jobs of the last successful IO cycle; until there
+	// is one, or without the job cgroups, they only collect the device-level
+	// metrics.
+	var jobsMu sync.Mutex
+	var latestJobs []slurmJob
+
+	// jobsAvailable is set once the job cgroups are found.
+	var jobsAvailable atomic.Bool
+	// The exporter is ready once every loop has completed a cycle, whether
+	// it succeeded or not, so that no series is missing for lack of one.
+	var jobsCollected, gpusCollected atomic.Bool
+	markCollected := func(collected *atomic.Bool) {
+		collected.Store(true)
+		if gpusCollected.Load() && (jobsCollected.Load() || !jobsAvailable.Load()) {
+			metrics.ready.Set(1)
+		}
+	}
+
+	collectJobs := func(ctx context.Context) {
+		metrics.clockWatch.check(metrics.clock)
+		defer markCollected(&jobsCollected)
+		var jobs []slurmJob
+		ok := runCollector(ctx, metrics, "io", func() (err error) {
+			jobs, err = collectIOMetrics(ctx, cfg, metrics)
+			return err
+		})
+		if !ok {
+			return
+		}
+		jobsMu.Lock()
+		latestJobs = jobs
+		jobsMu.Unlock()
+
+		jobIDs := slurmJobIDs(jobs)
+		// The bucket of invalid job IDs is no job scontrol knows.
+		delete(jobIDs, cfg.Label.InvalidJobID)
+		if metadataCache != nil {
+			runCollector(ctx, metrics, "slurm", func() error { return collectJobInfo(ctx, metadataCache, jobInfo, jobGPUAllocated, jobIDs) })
+		}
+		runCollector(ctx, metrics, "runtime", func() error { return runtimes.collect(ctx, jobs) })
+		if accounting != nil {
+			runCollector(ctx, metrics, "gpu_accounting", func() error { return accounting.collect(ctx, jobs) })
+		}
+		if network != nil {
+			runCollector(ctx, metrics, "network", func() error { return network.collect(ctx, jobs) })
+		}
+		if ioStat != nil {
+			runCollector(ctx, metrics, "io_stat", func() error { return ioStat.collect(ctx, jobs) })
+		}
+		if oomKills != nil {
+			runCollector(ctx, metrics, "oom_kills", func() error { return oomKills.collect(ctx, jobs) })
+		}
+		if scratch != nil {
+			runCollector(ctx, metrics, "scratch", func() error { return scratch.collect(ctx, jobs) })
+		}
+	}
+
+	collectGPUs := func(ctx context.Context) {
+		metrics.clockWatch.check(metrics.clock)
+		defer markCollected(&gpusCollected)
+		jobsMu.Lock()
+		jobs := latestJobs
+		jobsMu.Unlock()
+		var appsErr error
+		runCollector(ctx, metrics, "gpu", func() (err error) {
+			err, appsErr = collectGPUMetrics(ctx, cfg, metrics, source, jobs)
+			return err
+		})
+		runCollector(ctx, metrics, "gpu_apps", func() error { return appsErr })
+		// There is no driver to ask about with -gpu.fixture-file.
+		if !driver.read && cfg.GPU.FixtureFile == "" {
+			runCollector(ctx, metrics, "gpu_driver", func() error { return driver.collect(ctx) })
+		}
+	}
+
+	// done is closed once the loops have stopped, or right after startup
+	// with -scrape-mode=scrape, which has none.
+	done := make(chan struct{})
+	// With -scrape-mode=interval scrapes are served from a snapshot taken
+	// at the end of every cycle, so that they never wait for one. The first
+	// is taken before the loops start, so it can't replace a later one.
+	var snapshot *snapshotGatherer
+	if cfg.ScrapeMode != "scrape" {
+		snapshot = newSnapshotGatherer(metrics.topology.wrap(metrics.registry))
+	}
 	go func() {
-		ticker := time.NewTicker(2 * time.Second)
-		defer ticker.Stop()
-		for range ticker.C {
-			jobIDs := collectIOMetrics()
-			if jobIDs != nil {
-				collectGPUMetrics(jobIDs)
+		defer close(done)
+
+		// Without the job cgroup hierarchy (Slurm or Kubernetes not running,
+		// or cgroups not mounted) no job can be found, so rather than failing
+		// every cycle, only the device-level GPU metrics are collected. The
+		// wait happens here so that the metrics are served meanwhile.
+		root := checkJobsRoot(cfg)
+		if cfg.Startup.Timeout > 0 {
+			root = waitUntilReady(ctx, cfg, metrics.clock, cfg.Startup.Timeout)
+		}
+		// Stored even if cancelled, for the final cycle.
+		jobsAvailable.Store(root.ok)
+		if ctx.Err() != nil {
+			return
+		}
+		if !root.ok {
+			fmt.Printf("WARN: %s, disabling the job collectors and exporting device-level GPU metrics only\n", root.detail)
+		}
+		if cfg.ScrapeMode == "scrape" {
+			return
+		}
+
+		// Offset the first cycle, and with it the ticker's phase, so that
+		// nodes started together (e.g. after a cluster reboot) don't hit
+		// nvidia-smi and the cgroup filesystem in lockstep.
+		if cfg.Collector.Jitter > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-metrics.clock.After(collectionJitter(cfg.Collector.Jitter)):
 			}
 		}
+
+		var wg sync.WaitGroup
+		if root.ok {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				runEvery(ctx, metrics.clock, cfg.IO.Interval, func() {
+					collectJobs(ctx)
+					snapshot.update()
+				})
+			}()
+		}
+		runEvery(ctx, metrics.clock, cfg.GPU.Interval, func() {
+			collectGPUs(ctx)
+			snapshot.update()
+		})
+		wg.Wait()
 	}()
 
-	http.Handle("/metrics", promhttp.Handler())
-	fmt.Println("Serving metrics at /metrics")
-	http.ListenAndServe(":9060", nil)
+	// A cycle collects the jobs first, so that the GPU metrics are
+	// attributed to the jobs running now.
+	collect := func(ctx context.Context) {
+		if jobsAvailable.Load() {
+			collectJobs(ctx)
+		}
+		collectGPUs(ctx)
+	}
+
+	if cfg.ScrapeMode == "scrape" {
+		gatherer := &scrapeGatherer{Gatherer: metrics.registry, ctx: ctx, collect: collect, clock: metrics.clock}
+		// Scrapes hold the gatherer's lock, so the final cycle doesn't run
+		// concurrently with one, and its metrics are the ones pushed.
+		final := func(ctx context.Context) {
+			gatherer.mu.Lock()
+			defer gatherer.mu.Unlock()
+			collect(ctx)
+			gatherer.collected = gatherer.clock.Now()
+		}
+		return metrics.topology.wrap(gatherer), final
+	}
+
+	// The final cycle waits for the loops to stop, as the collectors aren't
+	// safe for concurrent cycles.
+	final := func(ctx context.Context) {
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+		}
+		collect(ctx)
+		snapshot.update()
+	}
+
+	return snapshot, final
+}
+
+func main() {
+	cfg, err := parseConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+		os.Exit(1)
+	}
+	debugEnabled = cfg.Log.Debug
+	memoryInMiB = cfg.Metrics.MemoryUnit == "mib"
+
+	if cfg.Check {
+		if !runCheck(cfg) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if cfg.Lint {
+		if !runLint(cfg) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Cancelled on SIGINT/SIGTERM so an in-progress collection is interrupted
+	// and the exporter shuts down gracefully.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var gatherer prometheus.Gatherer
+	var finalCycle func(context.Context)
+	var jobs *jobSnapshot
+	var errs *errorLog
+	if cfg.Mode == "aggregator" {
+		gatherer = newAggregator(cfg.Peers)
+	} else {
+		if cfg.Debug.Endpoints {
+			jobs = &jobSnapshot{}
+			errs = &errorLog{}
+		}
+		gatherer, finalCycle = startCollection(ctx, cfg, jobs, errs)
+	}
+
+	switch cfg.Output.Mode {
+	case "prometheus":
+		http.Handle(cfg.Web.TelemetryPath, metricsHandler(gatherer))
+		http.Handle("/", landingHandler(cfg.Web.TelemetryPath))
+		if jobs != nil {
+			http.Handle("/debug/jobs", jobs)
+			http.Handle("/debug/errors", errs)
+		}
+		tlsConfig, err := serverTLSConfig(cfg.Web)
+		if err != nil {
+			fmt.Printf("ERROR: %s\n", err)
+			os.Exit(1)
+		}
+		// Without timeouts, a scraper that stalls mid-request holds its
+		// connection and goroutine forever.
+		server := &http.Server{
+			Addr:              ":9060",
+			TLSConfig:         tlsConfig,
+			ReadHeaderTimeout: cfg.Web.ReadHeaderTimeout,
+			ReadTimeout:       cfg.Web.ReadTimeout,
+			WriteTimeout:      cfg.Web.WriteTimeout,
+			IdleTimeout:       cfg.Web.IdleTimeout,
+			MaxHeaderBytes:    cfg.Web.MaxHeaderBytes,
+		}
+		go func() {
+			<-ctx.Done()
+			server.Shutdown(context.Background())
+		}()
+
+		fmt.Printf("Serving metrics at %s\n", cfg.Web.TelemetryPath)
+		if tlsConfig != nil {
+			// The certificate is already in TLSConfig.
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			fmt.Printf("ERROR: %s\n", err)
+			os.Exit(1)
+		}
+	case "otlp":
+		shutdown, err := startOTLPExporter(ctx, gatherer, cfg.OTLP.Endpoint, cfg.OTLP.Interval)
+		if err != nil {
+			fmt.Printf("ERROR: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Pushing metrics to %s every %s\n", cfg.OTLP.Endpoint, cfg.OTLP.Interval)
+
+		<-ctx.Done()
+		if err := shutdown(context.Background()); err != nil {
+			fmt.Printf("WARN: Failed to flush OTLP exporter: %s\n", err)
+		}
+	}
+
+	// The last state before e.g. a node drain would otherwise be lost with
+	// the exporter.
+	if cfg.Pushgateway.URL != "" {
+		pushCtx, cancel := context.WithTimeout(context.Background(), finalPushTimeout)
+		defer cancel()
+		if finalCycle != nil {
+			finalCycle(pushCtx)
+		}
+		if err := pushFinalMetrics(pushCtx, gatherer, cfg.Pushgateway.URL); err != nil {
+			fmt.Printf("WARN: Failed to push the final metrics: %s\n", err)
+		} else {
+			fmt.Printf("Pushed the final metrics to %s\n", cfg.Pushgateway.URL)
+		}
+	}
 }
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/expfmt"
+)
+
+// testJobDir is the cgroup directory of job 42 of UID 1000 in the default
+// -cgroup.slurm-paths, relative to rootfs.
+const testJobDir = slurmCgroupPath + "/uid_1000/job_42"
+
+// newTestConfig returns the configuration the exporter would run with given
+// args.
+func newTestConfig(t *testing.T, args ...string) *Config {
+	t.Helper()
+	cfg, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), args)
+	if err != nil {
+		t.Fatalf("parseConfig(%q): %v", args, err)
+	}
+	return cfg
+}
+
+// newTestMetrics returns the metrics of cfg, as startCollection creates them.
+func newTestMetrics(cfg *Config) *exporterMetrics {
+	return newExporterMetrics(cfg.Metrics, cfg.GPU, cfg.Label.extra)
+}
+
+// newTestRootfs points rootfs at a fake tree holding files, by path relative
+// to it, for the duration of the test, and returns its directory.
+func newTestRootfs(t testing.TB, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for path, content := range files {
+		writeTestFile(t, filepath.Join(dir, path), content)
+	}
+	previous := rootfs
+	rootfs = dir
+	t.Cleanup(func() { rootfs = previous })
+	return dir
+}
+
+// writeTestFile writes content to path, creating its parent directories.
+func writeTestFile(t testing.TB, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGPUMemorySummedPerJob(t *testing.T) {
+	newTestRootfs(t, map[string]string{
+		testJobDir + "/cgroup.procs": "100\n101\n",
+	})
+	fixtures := t.TempDir()
+	gpus := filepath.Join(fixtures, "gpus.csv")
+	apps := filepath.Join(fixtures, "apps.csv")
+	writeTestFile(t, gpus, "gpu_uuid, index, utilization.gpu [%]\nGPU-a, 0, 80\nGPU-b, 1, 0\n")
+	// Two processes of job 42 on GPU 0, one on GPU 1.
+	writeTestFile(t, apps, "100, 1024 MiB, GPU-a\n101, 512 MiB, GPU-a\n101, 256 MiB, GPU-b\n")
+
+	cfg := newTestConfig(t, "-gpu.fixture-file="+gpus, "-gpu.apps-fixture-file="+apps)
+	m := newTestMetrics(cfg)
+	jobs, err := walkJobs(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	devicesErr, appsErr := collectGPUMetrics(context.Background(), cfg, m, newFixtureSource(gpus), jobs)
+	if devicesErr != nil || appsErr != nil {
+		t.Fatalf("collectGPUMetrics: %v, %v", devicesErr, appsErr)
+	}
+
+	for _, tc := range []struct {
+		gpuID string
+		want  float64
+	}{
+		{"0", 1536 * 1024 * 1024},
+		{"1", 256 * 1024 * 1024},
+	} {
+		if got := testutil.ToFloat64(m.gpuMemoryUsage.WithLabelValues(tc.gpuID, "42")); got != tc.want {
+			t.Errorf("gpu_memory_usage_bytes{gpu_id=%q,job_id=\"42\"} = %v, want %v", tc.gpuID, got, tc.want)
+		}
+	}
+	if got, want := testutil.ToFloat64(m.jobGPUMemoryUsage.WithLabelValues("42")), float64(1792*1024*1024); got != want {
+		t.Errorf("job_gpu_memory_usage_bytes{job_id=\"42\"} = %v, want %v", got, want)
+	}
+}
+
+func TestRunCollectorRecoversPanics(t *testing.T) {
+	m := newTestMetrics(newTestConfig(t))
+
+	ok := runCollector(context.Background(), m, "io", func() error {
+		var gpus []string
+		// An index out of range, as from malformed nvidia-smi output.
+		_ = gpus[0]
+		return nil
+	})
+	if ok {
+		t.Error("runCollector reported a panicking cycle as successful")
+	}
+	if got := testutil.ToFloat64(m.collectionErrors.WithLabelValues("io")); got != 1 {
+		t.Errorf("job_exporter_collection_errors_total{collector=\"io\"} = %v, want 1", got)
+	}
+
+	// The next cycle runs as usual.
+	if !runCollector(context.Background(), m, "io", func() error { return nil }) {
+		t.Error("runCollector reported the cycle after a panic as failed")
+	}
+	if got := testutil.ToFloat64(m.lastCollection.WithLabelValues("io")); got == 0 {
+		t.Error("job_exporter_last_collection_timestamp_seconds{collector=\"io\"} not set after the cycle following a panic")
+	}
+}
+
+func TestPIDIOSeriesDeletedOnExit(t *testing.T) {
+	m := newTestMetrics(newTestConfig(t, "-metrics.max-series=1"))
+
+	m.setPIDIOTotals(map[pidJob]ioTotals{{pid: "100", jobID: "42"}: {read: 10, write: 20}})
+	// PID 100 exited and PID 101 started, which only fits under the limit
+	// once the series of PID 100 is gone.
+	m.setPIDIOTotals(map[pidJob]ioTotals{{pid: "101", jobID: "42"}: {read: 30, write: 40}})
+
+	if got := testutil.CollectAndCount(m.ioReadBytes); got != 1 {
+		t.Errorf("io_read_bytes_total has %d series, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.ioReadBytes.WithLabelValues("101", "42")); got != 30 {
+		t.Errorf("io_read_bytes_total{pid=\"101\",job_id=\"42\"} = %v, want 30", got)
+	}
+	if got := testutil.ToFloat64(m.droppedSeries.WithLabelValues("io_read_bytes_total")); got != 0 {
+		t.Errorf("job_exporter_dropped_series_total{metric=\"io_read_bytes_total\"} = %v, want 0", got)
+	}
+	if len(m.ioReadBytes.last) != 1 {
+		t.Errorf("io_read_bytes_total holds the last reading of %d processes, want 1", len(m.ioReadBytes.last))
+	}
+}
+
+func TestReadProcIO(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		content   string
+		wantRead  float64
+		wantWrite float64
+	}{
+		{
+			name:      "full file",
+			content:   "rchar: 4096\nwchar: 8192\nsyscr: 10\nsyscw: 20\nread_bytes: 123456789\nwrite_bytes: 987654321\ncancelled_write_bytes: 0\n",
+			wantRead:  123456789,
+			wantWrite: 987654321,
+		},
+		{
+			// Of long-running processes, exact up to 2^53 bytes.
+			name:      "large counters",
+			content:   "read_bytes: 1099511627776\nwrite_bytes: 4503599627370496\n",
+			wantRead:  1099511627776,
+			wantWrite: 4503599627370496,
+		},
+		{
+			name:    "missing counters",
+			content: "rchar: 4096\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			newTestRootfs(t, map[string]string{"/proc/100/io": tc.content})
+			read, write, err := readProcIO("100")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if read != tc.wantRead || write != tc.wantWrite {
+				t.Errorf("readProcIO() = %v, %v, want %v, %v", read, write, tc.wantRead, tc.wantWrite)
+			}
+		})
+	}
+
+	newTestRootfs(t, nil)
+	if _, _, err := readProcIO("100"); !processExited(err) {
+		t.Errorf("readProcIO() of an exited process = %v, want a not exist error", err)
+	}
+}
+
+func TestRunCollectorTimestampFromClock(t *testing.T) {
+	m := newTestMetrics(newTestConfig(t))
+	clk := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	m.clock = clk
+
+	runCollector(context.Background(), m, "io", func() error { return nil })
+	clk.advance(time.Minute)
+	// A failed cycle leaves the timestamp of the last successful one.
+	runCollector(context.Background(), m, "io", func() error { return errors.New("cgroup root missing") })
+
+	if got, want := testutil.ToFloat64(m.lastCollection.WithLabelValues("io")), float64(clk.now.Add(-time.Minute).Unix()); got != want {
+		t.Errorf("job_exporter_last_collection_timestamp_seconds{collector=\"io\"} = %v, want %v", got, want)
+	}
+}
+
+func TestCollectIOMetricsFakeRootfs(t *testing.T) {
+	newTestRootfs(t, map[string]string{
+		testJobDir + "/cgroup.procs":        "100\n",
+		testJobDir + "/step_0/cgroup.procs": "101\n",
+		"/proc/100/io":                      "rchar: 1\nwchar: 2\nread_bytes: 4096\nwrite_bytes: 8192\n",
+		"/proc/100/cgroup":                  "4:cpu,cpuacct:/slurm/uid_1000/job_42\n",
+		"/proc/101/io":                      "rchar: 1\nwchar: 2\nread_bytes: 1000000\nwrite_bytes: 0\n",
+		"/proc/101/cgroup":                  "4:cpu,cpuacct:/slurm/uid_1000/job_42/step_0\n",
+	})
+	cfg := newTestConfig(t, "-metrics.granularity=both")
+	m := newTestMetrics(cfg)
+	m.procIO = true
+
+	jobs, err := collectIOMetrics(context.Background(), cfg, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != "42" || jobs[0].UID != "1000" || len(jobs[0].PIDs) != 2 {
+		t.Fatalf("collectIOMetrics() found %+v, want job 42 of UID 1000 with 2 PIDs", jobs)
+	}
+
+	want := `
+# HELP io_read_bytes_total Bytes the process caused to be read from storage, from read_bytes in /proc/<pid>/io.
+# TYPE io_read_bytes_total counter
+io_read_bytes_total{job_id="42",pid="100"} 4096
+io_read_bytes_total{job_id="42",pid="101"} 1e+06
+# HELP io_write_bytes_total Bytes the process caused to be written to storage, from write_bytes in /proc/<pid>/io.
+# TYPE io_write_bytes_total counter
+io_write_bytes_total{job_id="42",pid="100"} 8192
+io_write_bytes_total{job_id="42",pid="101"} 0
+# HELP job_proc_io_read_bytes Bytes the job's running processes caused to be read from storage, summed over their /proc/<pid>/io.
+# TYPE job_proc_io_read_bytes gauge
+job_proc_io_read_bytes{job_id="42"} 1.004096e+06
+# HELP job_proc_io_write_bytes Bytes the job's running processes caused to be written to storage, summed over their /proc/<pid>/io.
+# TYPE job_proc_io_write_bytes gauge
+job_proc_io_write_bytes{job_id="42"} 8192
+`
+	if err := testutil.GatherAndCompare(m.registry, strings.NewReader(want),
+		"io_read_bytes_total", "io_write_bytes_total", "job_proc_io_read_bytes", "job_proc_io_write_bytes"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRegisterSkipsDuplicates(t *testing.T) {
+	newGauge := func() *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_gauge", Help: "Test gauge."}, []string{"job_id"})
+	}
+	reg := prometheus.NewRegistry()
+	first := newGauge()
+	register(reg, first)
+	first.WithLabelValues("42").Set(1)
+	// As when the collectors of a reloaded configuration are created again.
+	register(reg, first, newGauge())
+	if got := testutil.CollectAndCount(reg, "test_gauge"); got != 1 {
+		t.Errorf("test_gauge has %d series, want 1", got)
+	}
+
+	// Two sets of metrics don't share a registry.
+	cfg := newTestConfig(t)
+	newTestMetrics(cfg)
+	newTestMetrics(cfg)
+}
+
+func BenchmarkReadPIDIOs(b *testing.B) {
+	// A job with thousands of processes, e.g. an MPI job on a large node.
+	const numPIDs = 5000
+	files := make(map[string]string, numPIDs)
+	pids := make([]string, numPIDs)
+	for i := range pids {
+		pids[i] = strconv.Itoa(1000 + i)
+		files["/proc/"+pids[i]+"/io"] = "rchar: 1\nwchar: 2\nread_bytes: 4096\nwrite_bytes: 8192\n"
+	}
+	newTestRootfs(b, files)
+
+	for _, concurrency := range []int{1, 8} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				read := 0
+				err := readPIDIOs(context.Background(), pids, concurrency, 0, 0, func(result pidIO) error {
+					read++
+					return result.err
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if read != numPIDs {
+					b.Fatalf("readPIDIOs() handled %d PIDs, want %d", read, numPIDs)
+				}
+			}
+		})
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestCollectionGolden runs a full cycle over a fake rootfs and the GPU
+// fixtures in testdata, and compares the exposition with
+// testdata/metrics.golden. Run with -update to rewrite it after an intended
+// change of the output.
+func TestCollectionGolden(t *testing.T) {
+	newTestRootfs(t, map[string]string{
+		testJobDir + "/cgroup.procs":        "100\n",
+		testJobDir + "/step_0/cgroup.procs": "101\n",
+		"/proc/100/io":                      "rchar: 1\nwchar: 2\nread_bytes: 4096\nwrite_bytes: 8192\n",
+		"/proc/100/cgroup":                  "4:cpu,cpuacct:/slurm/uid_1000/job_42\n",
+		"/proc/101/io":                      "rchar: 1\nwchar: 2\nread_bytes: 1000000\nwrite_bytes: 0\n",
+		"/proc/101/cgroup":                  "4:cpu,cpuacct:/slurm/uid_1000/job_42/step_0\n",
+	})
+	cfg := newTestConfig(t, "-gpu.fixture-file=testdata/gpus.csv", "-gpu.apps-fixture-file=testdata/apps.csv")
+	m := newTestMetrics(cfg)
+	m.clock = &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	m.procIO = true
+
+	ctx := context.Background()
+	var jobs []slurmJob
+	if !runCollector(ctx, m, "io", func() (err error) {
+		jobs, err = collectIOMetrics(ctx, cfg, m)
+		return err
+	}) {
+		t.Fatal("io collection failed")
+	}
+	var appsErr error
+	runCollector(ctx, m, "gpu", func() (err error) {
+		err, appsErr = collectGPUMetrics(ctx, cfg, m, newFixtureSource(cfg.GPU.FixtureFile), jobs)
+		return err
+	})
+	runCollector(ctx, m, "gpu_apps", func() error { return appsErr })
+
+	const golden = "testdata/metrics.golden"
+	if *update {
+		families, err := m.registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		for _, family := range families {
+			if _, err := expfmt.MetricFamilyToText(&buf, family); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(golden, buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.Open(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer want.Close()
+	if err := testutil.GatherAndCompare(m.registry, want); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWalkJobsMergesInvalidJobIDs(t *testing.T) {
+	newTestRootfs(t, map[string]string{
+		testJobDir + "/cgroup.procs":                         "100\n",
+		slurmCgroupPath + "/uid_1000/job_batch/cgroup.procs": "200\n201\n",
+		slurmCgroupPath + "/uid_1001/job_x.y/cgroup.procs":   "300\n",
+	})
+	cfg := newTestConfig(t)
+	jobs, err := walkJobs(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byID := make(map[string]slurmJob)
+	for _, job := range jobs {
+		if _, seen := byID[job.ID]; seen {
+			t.Errorf("job %s listed twice", job.ID)
+		}
+		byID[job.ID] = job
+	}
+	if len(byID) != 2 || len(byID["42"].PIDs) != 1 || len(byID["invalid"].PIDs) != 3 {
+		t.Fatalf("walkJobs() = %+v, want job 42 with 1 PID and invalid with 3", jobs)
+	}
+
+	m := newTestMetrics(cfg)
+	m.setJobShape(jobs)
+	if got := testutil.ToFloat64(m.jobProcessCount.WithLabelValues("invalid")); got != 3 {
+		t.Errorf("job_process_count{job_id=\"invalid\"} = %v, want 3", got)
+	}
+}
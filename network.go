@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type netDevKey struct {
+	jobID string
+	netns string
+}
+
+type netDevCounters struct {
+	rx float64
+	tx float64
+}
+
+// networkCollector exposes the network traffic of jobs. It holds the counters
+// last read for each job and network namespace, so that only their increase
+// is added to the job's counters, and the running totals of each job.
+type networkCollector struct {
+	rxBytes *limitedTotalCounter
+	txBytes *limitedTotalCounter
+
+	last   map[netDevKey]netDevCounters
+	totals map[string]netDevCounters
+}
+
+// newNetworkCollector creates the network metrics, limited to maxSeries
+// series like the other job-level metrics, and registers them with reg.
+func newNetworkCollector(reg prometheus.Registerer, maxSeries int, droppedSeries *prometheus.CounterVec) *networkCollector {
+	c := &networkCollector{
+		rxBytes: newLimitedTotalCounter(prometheus.CounterOpts{
+			Name: "job_network_rx_bytes_total",
+			Help: "Bytes received on the network namespaces of the job's processes, excluding lo, from /proc/<pid>/net/dev.",
+		}, []string{"job_id"}, maxSeries, droppedSeries),
+
+		txBytes: newLimitedTotalCounter(prometheus.CounterOpts{
+			Name: "job_network_tx_bytes_total",
+			Help: "Bytes transmitted on the network namespaces of the job's processes, excluding lo, from /proc/<pid>/net/dev.",
+		}, []string{"job_id"}, maxSeries, droppedSeries),
+
+		last:   make(map[netDevKey]netDevCounters),
+		totals: make(map[string]netDevCounters),
+	}
+	register(reg, c.rxBytes, c.txBytes)
+	return c
+}
+
+// collect adds the traffic of each job's network namespaces to its counters,
+// and removes the series of jobs that ended. /proc/<pid>/net/dev reports
+// counters per network namespace, not per process, so each namespace is
+// read once per job. Jobs that share the host namespace, which is the
+// default under Slurm, therefore see all of the node's traffic, and per-job
+// attribution is only exact for jobs running in their own namespace.
+func (c *networkCollector) collect(ctx context.Context, jobs []slurmJob) error {
+	current := make(map[netDevKey]netDevCounters)
+	totals := make(map[string]netDevCounters, len(jobs))
+
+	for _, job := range jobs {
+		total := c.totals[job.ID]
+		for _, pid := range job.PIDs {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			netns, err := os.Readlink(hostPath(fmt.Sprintf("/proc/%s/ns/net", pid)))
+			if err != nil {
+				if !processExited(err) {
+					fmt.Printf("WARN: Failed to read network namespace of PID %s: %v\n", pid, err)
+				}
+				continue
+			}
+			key := netDevKey{jobID: job.ID, netns: netns}
+			if _, seen := current[key]; seen {
+				continue
+			}
+
+			counters, err := readNetDev(pid)
+			if err != nil {
+				if !processExited(err) {
+					fmt.Printf("WARN: Failed to read network counters of PID %s: %v\n", pid, err)
+				}
+				continue
+			}
+			current[key] = counters
+
+			// Add the increase since the last cycle. The first reading of
+			// a namespace, or one whose counters went down, is only a
+			// baseline: in the host namespace the counters hold the node's
+			// traffic since boot, not the job's.
+			if last, ok := c.last[key]; ok && counters.rx >= last.rx && counters.tx >= last.tx {
+				total.rx += counters.rx - last.rx
+				total.tx += counters.tx - last.tx
+			}
+		}
+		totals[job.ID] = total
+		c.rxBytes.Set(prometheus.Labels{"job_id": job.ID}, total.rx)
+		c.txBytes.Set(prometheus.Labels{"job_id": job.ID}, total.tx)
+	}
+
+	for jobID := range c.totals {
+		if _, exists := totals[jobID]; !exists {
+			c.rxBytes.Delete(prometheus.Labels{"job_id": jobID})
+			c.txBytes.Delete(prometheus.Labels{"job_id": jobID})
+		}
+	}
+	c.last = current
+	c.totals = totals
+	return nil
+}
+
+// readNetDev sums the receive and transmit byte counters of every interface
+// except lo in /proc/<pid>/net/dev.
+func readNetDev(pid string) (netDevCounters, error) {
+	file, err := os.Open(hostPath(fmt.Sprintf("/proc/%s/net/dev", pid)))
+	if err != nil {
+		return netDevCounters{}, err
+	}
+	defer file.Close()
+
+	var counters netDevCounters
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Interface lines look like "  eth0: <8 receive fields> <8 transmit fields>";
+		// the two header lines have no colon-terminated interface name.
+		iface, values, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || strings.TrimSpace(iface) == "lo" {
+			continue
+		}
+		fields := strings.Fields(values)
+		if len(fields) < 16 {
+			continue
+		}
+		rx, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			continue
+		}
+		tx, err := strconv.ParseFloat(fields[8], 64)
+		if err != nil {
+			continue
+		}
+		counters.rx += rx
+		counters.tx += tx
+	}
+	return counters, scanner.Err()
+}
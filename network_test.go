@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// netDevContent returns a /proc/<pid>/net/dev with lo and eth0 having
+// received rx and transmitted tx bytes each.
+func netDevContent(rx, tx string) string {
+	return "Inter-|   Receive                                                |  Transmit\n" +
+		" face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed\n" +
+		"    lo: " + rx + " 1 0 0 0 0 0 0 " + tx + " 1 0 0 0 0 0 0\n" +
+		"  eth0: " + rx + " 1 0 0 0 0 0 0 " + tx + " 1 0 0 0 0 0 0\n"
+}
+
+func TestNetworkCollector(t *testing.T) {
+	dir := newTestRootfs(t, map[string]string{
+		"/proc/100/net/dev": netDevContent("1000000", "2000000"),
+	})
+	// The host network namespace.
+	if err := os.MkdirAll(filepath.Join(dir, "/proc/100/ns"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("net:[4026531840]", filepath.Join(dir, "/proc/100/ns/net")); err != nil {
+		t.Fatal(err)
+	}
+	droppedSeries := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "dropped"}, []string{"metric"})
+	c := newNetworkCollector(prometheus.NewRegistry(), 0, droppedSeries)
+	collect := func(jobs ...slurmJob) {
+		t.Helper()
+		if err := c.collect(context.Background(), jobs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	job := slurmJob{ID: "42", PIDs: []string{"100"}}
+
+	// The host namespace's traffic since boot isn't the job's.
+	collect(job)
+	if got := testutil.ToFloat64(c.rxBytes.WithLabelValues("42")); got != 0 {
+		t.Errorf("job_network_rx_bytes_total after the first cycle = %v, want 0", got)
+	}
+
+	writeTestFile(t, filepath.Join(dir, "/proc/100/net/dev"), netDevContent("1000500", "2000700"))
+	collect(job)
+	if got := testutil.ToFloat64(c.rxBytes.WithLabelValues("42")); got != 500 {
+		t.Errorf("job_network_rx_bytes_total = %v, want 500", got)
+	}
+	if got := testutil.ToFloat64(c.txBytes.WithLabelValues("42")); got != 700 {
+		t.Errorf("job_network_tx_bytes_total = %v, want 700", got)
+	}
+
+	// The job ended.
+	collect()
+	if got := testutil.CollectAndCount(c.rxBytes); got != 0 {
+		t.Errorf("job_network_rx_bytes_total has %d series after the job ended, want 0", got)
+	}
+}
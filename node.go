@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// nodeGPUMetrics rolls the per-GPU metrics of a cycle up to the node, which
+// saves aggregating them in every query that needs a single occupancy number
+// per node. Excluded GPUs are left out, as from the per-GPU metrics.
+type nodeGPUMetrics struct {
+	count       prometheus.Gauge
+	utilization *prometheus.GaugeVec
+	memoryUsed  *prometheus.GaugeVec
+}
+
+// newNodeGPUMetrics creates the node rollups and registers them with reg.
+// The average utilization and the memory sum have no labels; they are
+// vectors so that they can be left out when no GPU reports the value.
+func newNodeGPUMetrics(reg prometheus.Registerer) *nodeGPUMetrics {
+	n := &nodeGPUMetrics{
+		count: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "node_gpu_count",
+			Help: "Number of GPUs the GPU source reported in the last collection cycle.",
+		}),
+		utilization: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "node_gpu_utilization_avg",
+			Help: "Average of gpu_utilization over the node's GPUs.",
+		}, nil),
+		memoryUsed: prometheus.NewGaugeVec(memoryGaugeOpts(prometheus.GaugeOpts{
+			Name: "node_gpu_memory_used_bytes",
+			Help: "Sum of gpu_memory_used_bytes over the node's GPUs in bytes, when it is reported (memory.used in -gpu.query, nvidia-smi backend).",
+		}), nil),
+	}
+	register(reg, n.count, n.utilization, n.memoryUsed)
+	return n
+}
+
+// update sets the rollups from the GPUs of a cycle and their utilization by
+// index. GPUs whose utilization or memory can't be read, e.g. in an error
+// state, count towards node_gpu_count only.
+func (n *nodeGPUMetrics) update(gpus []gpuInfo, utilization map[string]float64) {
+	n.count.Set(float64(len(gpus)))
+
+	if len(utilization) > 0 {
+		var sum float64
+		for _, value := range utilization {
+			sum += value
+		}
+		n.utilization.WithLabelValues().Set(sum / float64(len(utilization)))
+	} else {
+		n.utilization.Reset()
+	}
+
+	var memoryUsed float64
+	reported := false
+	for _, gpu := range gpus {
+		if used, err := parseMiB(gpu["memory.used"]); err == nil {
+			memoryUsed += used
+			reported = true
+		}
+	}
+	if reported {
+		n.memoryUsed.WithLabelValues().Set(memoryUsed)
+	} else {
+		n.memoryUsed.Reset()
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// oomCollector counts the processes of each job killed by the OOM killer,
+// from the memory controller of its cgroup: the oom_kill field of
+// memory.events on cgroup v2, which covers the job's whole subtree, or of
+// memory.oom_control on cgroup v1, which doesn't, so the job's step and task
+// cgroups are summed. Those cgroups go away when their step ends, so rather
+// than a sum that would then decrease, the increase of every cgroup since the
+// previous cycle is added to the counter.
+type oomCollector struct {
+	kills   *prometheus.CounterVec
+	manager string
+
+	// last holds the oom_kill count of every cgroup of every job, by job ID
+	// and cgroup directory.
+	last map[string]map[string]float64
+}
+
+// newOOMCollector creates the OOM kill counter and registers it with reg.
+// manager is the -workload.manager the jobs come from.
+func newOOMCollector(reg prometheus.Registerer, manager string) *oomCollector {
+	c := &oomCollector{
+		kills: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "job_memory_oom_kills_total",
+			Help: "Processes of the job killed by the OOM killer for exceeding its memory limit, from its memory cgroup.",
+		}, []string{"job_id"}),
+		manager: manager,
+		last:    make(map[string]map[string]float64),
+	}
+	register(reg, c.kills)
+	return c
+}
+
+// collect adds the OOM kills of every job since the previous cycle, and
+// removes the series of jobs that ended.
+func (c *oomCollector) collect(ctx context.Context, jobs []slurmJob) error {
+	current := make(map[string]map[string]float64)
+	for _, job := range jobs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		counts, err := c.readJob(job)
+		if err != nil {
+			return fmt.Errorf("failed to read the OOM kills of job %s: %v", job.ID, err)
+		}
+		if counts == nil {
+			// Keep the series of a job whose cgroup can't be found this
+			// cycle, e.g. between its processes, rather than counting its
+			// kills again once it is found.
+			if last, ok := c.last[job.ID]; ok {
+				current[job.ID] = last
+			}
+			continue
+		}
+
+		// Exposed from 0, so that the first kill is an increase.
+		counter := c.kills.WithLabelValues(job.ID)
+		for dir, count := range counts {
+			// A cgroup whose count went down was recreated, e.g. the step
+			// of the same ID on a requeued job.
+			if last, ok := c.last[job.ID][dir]; ok && count >= last {
+				count -= last
+			}
+			counter.Add(count)
+		}
+		current[job.ID] = counts
+	}
+
+	for jobID := range c.last {
+		if _, exists := current[jobID]; !exists {
+			c.kills.DeleteLabelValues(jobID)
+		}
+	}
+	c.last = current
+	return nil
+}
+
+// readJob returns the oom_kill count of the memory cgroups of job by
+// directory, or nil if it has none, e.g. without the memory controller or on
+// kernels that don't count OOM kills (before 4.13 on cgroup v1).
+func (c *oomCollector) readJob(job slurmJob) (map[string]float64, error) {
+	if dir, ok := findJobCgroup(job, c.manager, ""); ok {
+		count, err := readOOMKills(filepath.Join(dir, "memory.events"))
+		if processExited(err) || errors.Is(err, errNoOOMKills) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return map[string]float64{dir: count}, nil
+	}
+
+	root, ok := findJobCgroup(job, c.manager, "memory")
+	if !ok {
+		return nil, nil
+	}
+	counts := make(map[string]float64)
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Steps come and go while walking.
+			if processExited(err) {
+				return nil
+			}
+			return err
+		}
+		if entry.Name() != "memory.oom_control" {
+			return nil
+		}
+		count, err := readOOMKills(path)
+		if processExited(err) || errors.Is(err, errNoOOMKills) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		counts[filepath.Dir(path)] = count
+		return nil
+	})
+	if err != nil || len(counts) == 0 {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// errNoOOMKills is returned by readOOMKills for files without an oom_kill
+// field.
+var errNoOOMKills = errors.New("no oom_kill field")
+
+// readOOMKills returns the oom_kill field of a memory.events or
+// memory.oom_control file.
+func readOOMKills(path string) (float64, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		// Lines look like "oom_kill 2".
+		if value, ok := strings.CutPrefix(line, "oom_kill "); ok {
+			return strconv.ParseFloat(strings.TrimSpace(value), 64)
+		}
+	}
+	return 0, fmt.Errorf("%s: %w", path, errNoOOMKills)
+}
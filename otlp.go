@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	otelprom "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// startOTLPExporter periodically pushes everything gatherer collects to the
+// OTLP/HTTP collector at endpoint. The collectors keep updating the same
+// GaugeVecs; only the export path differs from the /metrics handler. The
+// returned function flushes and stops the exporter.
+func startOTLPExporter(ctx context.Context, gatherer prometheus.Gatherer, endpoint string, interval time.Duration) (func(context.Context) error, error) {
+	exporter, err := otlpmetrichttp.New(ctx, otlpmetrichttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+	}
+
+	reader := sdkmetric.NewPeriodicReader(exporter,
+		sdkmetric.WithInterval(interval),
+		sdkmetric.WithProducer(otelprom.NewMetricProducer(otelprom.WithGatherer(gatherer))),
+	)
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// gpuPID identifies a process on a GPU by the GPU's index and the PID.
+type gpuPID struct {
+	gpuID string
+	pid   string
+}
+
+// queryProcessSMUtilization samples the SM utilization of the processes on
+// every GPU with nvidia-smi pmon, the CLI counterpart of NVML's per-process
+// utilization samples. pmon samples over about a second, so it is only run
+// with -collector.process-utilization. Processes without a sample in the
+// interval are left out.
+func queryProcessSMUtilization(ctx context.Context) (map[gpuPID]float64, error) {
+	output, err := nvidiaSMI(ctx, "pmon", "-c", "1", "-s", "u").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	// The output starts with two header lines, e.g.
+	//   # gpu         pid   type     sm    mem    enc    dec    command
+	//   # Idx           #    C/G      %      %      %      %    name
+	// whose columns depend on the driver version, so look them up by name.
+	columns := map[string]int{}
+	utilization := make(map[gpuPID]float64)
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "#" {
+			if len(columns) == 0 {
+				for i, name := range fields[1:] {
+					columns[name] = i
+				}
+			}
+			continue
+		}
+
+		gpuCol, ok1 := columns["gpu"]
+		pidCol, ok2 := columns["pid"]
+		smCol, ok3 := columns["sm"]
+		if !ok1 || !ok2 || !ok3 {
+			return nil, fmt.Errorf("unexpected pmon header, gpu, pid or sm column missing")
+		}
+		if len(fields) <= smCol {
+			continue
+		}
+		// Idle GPUs and processes without a sample show "-".
+		sm, err := strconv.ParseFloat(fields[smCol], 64)
+		if err != nil || fields[pidCol] == "-" {
+			continue
+		}
+		utilization[gpuPID{gpuID: fields[gpuCol], pid: fields[pidCol]}] += sm
+	}
+	return utilization, nil
+}
+
+// attributeGPUUtilization splits the utilization of a GPU between the jobs
+// on it, in proportion to the SM utilization of their processes in jobSM.
+// Without SM samples for any of them, it is split equally.
+func attributeGPUUtilization(utilization float64, jobSM map[string]float64) map[string]float64 {
+	var total float64
+	for _, sm := range jobSM {
+		total += sm
+	}
+
+	shares := make(map[string]float64, len(jobSM))
+	for jobID, sm := range jobSM {
+		if total > 0 {
+			shares[jobID] = utilization * sm / total
+		} else {
+			shares[jobID] = utilization / float64(len(jobSM))
+		}
+	}
+	return shares
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAttributeGPUUtilization(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		utilization float64
+		jobSM       map[string]float64
+		want        map[string]float64
+	}{
+		{
+			name:        "single job",
+			utilization: 80,
+			jobSM:       map[string]float64{"1": 35},
+			want:        map[string]float64{"1": 80},
+		},
+		{
+			name:        "proportional to SM activity",
+			utilization: 90,
+			jobSM:       map[string]float64{"1": 60, "2": 30},
+			want:        map[string]float64{"1": 60, "2": 30},
+		},
+		{
+			name:        "SM activity summed over more than the utilization",
+			utilization: 50,
+			jobSM:       map[string]float64{"1": 75, "2": 25, "3": 0},
+			want:        map[string]float64{"1": 37.5, "2": 12.5, "3": 0},
+		},
+		{
+			name:        "equal split without SM samples",
+			utilization: 90,
+			jobSM:       map[string]float64{"1": 0, "2": 0, "3": 0},
+			want:        map[string]float64{"1": 30, "2": 30, "3": 30},
+		},
+		{
+			name:        "idle GPU",
+			utilization: 0,
+			jobSM:       map[string]float64{"1": 10, "2": 0},
+			want:        map[string]float64{"1": 0, "2": 0},
+		},
+		{
+			name:        "no job",
+			utilization: 70,
+			jobSM:       map[string]float64{},
+			want:        map[string]float64{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := attributeGPUUtilization(tc.utilization, tc.jobSM)
+			if len(got) != len(tc.want) {
+				t.Fatalf("attributeGPUUtilization() = %v, want %v", got, tc.want)
+			}
+			var sum float64
+			for jobID, want := range tc.want {
+				if math.Abs(got[jobID]-want) > 1e-9 {
+					t.Errorf("share of job %s = %v, want %v", jobID, got[jobID], want)
+				}
+				sum += got[jobID]
+			}
+			// The shares add up to the GPU's utilization.
+			if len(got) > 0 && math.Abs(sum-tc.utilization) > 1e-9 {
+				t.Errorf("shares add up to %v, want %v", sum, tc.utilization)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gpuPresence tracks which GPUs the node is expected to have and whether the
+// GPU source still reports them. A GPU that crashed, e.g. fell off the bus,
+// is omitted by nvidia-smi or makes the whole query fail, so its other
+// metrics just stop; gpu_present makes that visible. gpu_query_success
+// tells apart the cycles that couldn't read a GPU, which includes transient
+// query failures.
+type gpuPresence struct {
+	present      *prometheus.GaugeVec
+	querySuccess *prometheus.GaugeVec
+
+	// expected holds the indexes of the GPUs 0 to -gpu.expected-count and of
+	// every GPU seen since startup.
+	expected map[string]struct{}
+	gpu      GPUConfig
+}
+
+// newGPUPresence creates gpu_present and gpu_query_success and registers
+// them with reg. With gpu.ExpectedCount 0, the expected GPUs are the ones
+// seen since startup. Excluded GPUs are never expected.
+func newGPUPresence(reg prometheus.Registerer, gpu GPUConfig) *gpuPresence {
+	p := &gpuPresence{
+		present: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gpu_present",
+			Help: "Whether the GPU source reported the GPU in the last collection cycle. 0 for expected GPUs that are missing, e.g. fallen off the bus.",
+		}, []string{"gpu_id"}),
+		querySuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gpu_query_success",
+			Help: "Whether the last collection cycle could read the GPU's state.",
+		}, []string{"gpu_id"}),
+		expected: make(map[string]struct{}),
+		gpu:      gpu,
+	}
+	register(reg, p.present, p.querySuccess)
+
+	for i := 0; i < gpu.ExpectedCount; i++ {
+		if index := strconv.Itoa(i); !gpu.excludes(index, "") {
+			p.expected[index] = struct{}{}
+		}
+	}
+	for index := range p.expected {
+		p.present.WithLabelValues(index).Set(0)
+		p.querySuccess.WithLabelValues(index).Set(0)
+	}
+	return p
+}
+
+// update sets the metrics from the GPUs reported in a cycle, nil if the
+// query failed altogether. A reported GPU was read successfully if its
+// utilization is a number: GPUs in an error state report e.g. "[Unknown
+// Error]" or "[GPU requires reset]" instead.
+func (p *gpuPresence) update(gpus []gpuInfo) {
+	reported := make(map[string]struct{})
+	read := make(map[string]struct{})
+	for _, gpu := range gpus {
+		if p.gpu.excludes(gpu["index"], gpu["gpu_uuid"]) {
+			// Excluded by UUID, whose index isn't known beforehand.
+			if _, expected := p.expected[gpu["index"]]; expected {
+				delete(p.expected, gpu["index"])
+				p.present.DeleteLabelValues(gpu["index"])
+				p.querySuccess.DeleteLabelValues(gpu["index"])
+			}
+			continue
+		}
+		reported[gpu["index"]] = struct{}{}
+		if _, err := parsePercent(gpu["utilization.gpu"]); err == nil {
+			read[gpu["index"]] = struct{}{}
+		}
+		p.expected[gpu["index"]] = struct{}{}
+	}
+	for index := range p.expected {
+		if _, ok := reported[index]; ok {
+			p.present.WithLabelValues(index).Set(1)
+		} else {
+			p.present.WithLabelValues(index).Set(0)
+		}
+		if _, ok := read[index]; ok {
+			p.querySuccess.WithLabelValues(index).Set(1)
+		} else {
+			p.querySuccess.WithLabelValues(index).Set(0)
+		}
+	}
+}
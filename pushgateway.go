@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// pushgatewayJob is the job label of the metrics pushed to the Pushgateway.
+const pushgatewayJob = "job_metrics_exporter"
+
+// finalPushTimeout bounds the final collection cycle and push together, so
+// that an unreachable Pushgateway doesn't hold up shutdown.
+const finalPushTimeout = 30 * time.Second
+
+// pushFinalMetrics pushes everything gatherer collects to the Pushgateway at
+// url, grouped by job and instance, the node's hostname. It replaces the
+// metrics previously pushed by the same node.
+func pushFinalMetrics(ctx context.Context, gatherer prometheus.Gatherer, url string) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("failed to read the hostname: %v", err)
+	}
+	if err := push.New(url, pushgatewayJob).Grouping("instance", hostname).Gatherer(gatherer).PushContext(ctx); err != nil {
+		return fmt.Errorf("failed to push to %s: %v", url, err)
+	}
+	return nil
+}
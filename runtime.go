@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scontrolTimeLayout is the layout of the times scontrol reports, in the
+// local time zone of the node.
+const scontrolTimeLayout = "2006-01-02T15:04:05"
+
+// jobRuntime exposes how long each job has been running. The start time of a
+// job is its scontrol StartTime with -slurm.enrich, otherwise the change time
+// of its cgroup directory, which the kernel sets when the directory is
+// created. It is read once per job, as creating the cgroups of later job
+// steps changes it again. The bucket of invalid job IDs has no runtime, as it
+// is no job.
+type jobRuntime struct {
+	runtime *prometheus.GaugeVec
+	clock   clock
+	// cache is nil without -slurm.enrich.
+	cache        *jobMetadataCache
+	invalidJobID string
+	starts       map[string]time.Time
+}
+
+// newJobRuntime creates the job runtime metric and registers it with reg.
+// invalidJobID is -label.invalid-job-id.
+func newJobRuntime(reg prometheus.Registerer, clk clock, cache *jobMetadataCache, invalidJobID string) *jobRuntime {
+	r := &jobRuntime{
+		runtime: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "job_runtime_seconds",
+			Help: "Seconds since the job started, from its scontrol StartTime with -slurm.enrich, otherwise from the creation of its cgroup directory.",
+		}, []string{"job_id"}),
+		clock:        clk,
+		cache:        cache,
+		invalidJobID: invalidJobID,
+		starts:       make(map[string]time.Time),
+	}
+	register(reg, r.runtime)
+	return r
+}
+
+// collect sets the runtime of every job and removes the series of jobs that
+// ended.
+func (r *jobRuntime) collect(ctx context.Context, jobs []slurmJob) error {
+	now := r.clock.Now()
+	present := make(map[string]struct{}, len(jobs))
+	for _, job := range jobs {
+		// scontrol knows no such job, and its directories were created at
+		// different times.
+		if job.ID == r.invalidJobID {
+			continue
+		}
+		present[job.ID] = struct{}{}
+		start, ok := r.starts[job.ID]
+		if !ok {
+			var err error
+			start, err = r.startTime(ctx, job)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if processExited(err) {
+				// The job ended since its cgroup was listed.
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			r.starts[job.ID] = start
+		}
+		// The start time comes from another clock than now when it is the
+		// scontrol StartTime, or from the node's wall clock, which may have
+		// been stepped back since; either way the job can't have started in
+		// the future.
+		r.runtime.WithLabelValues(job.ID).Set(max(now.Sub(start).Seconds(), 0))
+	}
+
+	for jobID := range r.starts {
+		if _, ok := present[jobID]; !ok {
+			r.runtime.DeleteLabelValues(jobID)
+			delete(r.starts, jobID)
+		}
+	}
+	return nil
+}
+
+// startTime returns the start time of job, from scontrol if enrichment is
+// enabled and falling back to the change time of its cgroup directory.
+func (r *jobRuntime) startTime(ctx context.Context, job slurmJob) (time.Time, error) {
+	if r.cache != nil {
+		// StartTime is "Unknown" until the job is scheduled.
+		metadata, err := r.cache.get(ctx, job.ID)
+		if err != nil {
+			debugf("Failed to fetch the StartTime of job %s, using its cgroup directory: %v", job.ID, err)
+		} else if start, err := time.ParseInLocation(scontrolTimeLayout, metadata["StartTime"], time.Local); err == nil {
+			return start, nil
+		}
+	}
+
+	info, err := os.Stat(job.Dir)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read the start time of job %s: %w", job.ID, err)
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, fmt.Errorf("no change time for %s", job.Dir)
+	}
+	return time.Unix(stat.Ctim.Sec, stat.Ctim.Nsec), nil
+}
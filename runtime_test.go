@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestJobRuntimeSkipsInvalidJobIDs(t *testing.T) {
+	clk := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)}
+	cache := newJobMetadataCache(time.Minute)
+	cache.clock = clk
+	cache.fetch = func(ctx context.Context, jobID string) (jobMetadata, error) {
+		if jobID == "invalid" {
+			t.Errorf("scontrol called for the bucket of invalid job IDs")
+		}
+		return jobMetadata{"StartTime": "2024-01-01T11:00:00"}, nil
+	}
+	r := newJobRuntime(prometheus.NewRegistry(), clk, cache, "invalid")
+
+	jobs := []slurmJob{{ID: "42", Dir: t.TempDir()}, {ID: "invalid", Dir: t.TempDir()}}
+	if err := r.collect(context.Background(), jobs); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(r.runtime.WithLabelValues("42")); got != 3600 {
+		t.Errorf("job_runtime_seconds{job_id=\"42\"} = %v, want 3600", got)
+	}
+	r.runtime.DeleteLabelValues("42")
+	if got := testutil.CollectAndCount(r.runtime); got != 0 {
+		t.Errorf("job_runtime_seconds has %d series besides job 42, want 0", got)
+	}
+}
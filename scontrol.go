@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// jobMetadata holds the fields of `scontrol show job -o`, keyed by field name
+// (JobId, UserId, Partition, ...).
+type jobMetadata map[string]string
+
+type jobInfoLabel struct {
+	label string
+	field string
+}
+
+// jobInfoLabels maps the metadata labels of job_info to the scontrol field
+// they are read from.
+var jobInfoLabels = []jobInfoLabel{
+	{"user", "UserId"},
+	{"account", "Account"},
+	{"partition", "Partition"},
+	{"job_name", "JobName"},
+}
+
+// jobNameMaxLength is how many characters of a job name job_name keeps.
+const jobNameMaxLength = 64
+
+// sanitizeJobName returns name, which users choose freely, as a job_name
+// label value: characters other than ASCII letters, digits, '-', '_' and
+// '.' are replaced by '_', and it is truncated to jobNameMaxLength, so
+// that long generated names don't bloat the series.
+func sanitizeJobName(name string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, name)
+	// Only ASCII is left, so bytes are characters.
+	if len(sanitized) > jobNameMaxLength {
+		sanitized = sanitized[:jobNameMaxLength]
+	}
+	return sanitized
+}
+
+func jobInfoLabelNames() []string {
+	names := make([]string, len(jobInfoLabels))
+	for i, l := range jobInfoLabels {
+		names[i] = l.label
+	}
+	return names
+}
+
+// jobInfoVec is the job_info metric with the metadata labels that remain
+// after -label.keep and -label.drop, e.g. to withhold the user on
+// multi-tenant clusters. job_id is always kept.
+type jobInfoVec struct {
+	*prometheus.GaugeVec
+
+	labels []jobInfoLabel
+}
+
+// newJobInfoVec returns job_info with only the labels in keep, or all labels
+// if keep is empty, minus those in drop.
+func newJobInfoVec(keep, drop stringList) *jobInfoVec {
+	var labels []jobInfoLabel
+	names := []string{"job_id"}
+	for _, l := range jobInfoLabels {
+		if (len(keep) > 0 && !keep.contains(l.label)) || drop.contains(l.label) {
+			continue
+		}
+		labels = append(labels, l)
+		names = append(names, l.label)
+	}
+
+	return &jobInfoVec{
+		GaugeVec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "job_info",
+			Help: "Always 1, labeled with the Slurm job's metadata from scontrol.",
+		}, names),
+		labels: labels,
+	}
+}
+
+// newJobGPUAllocatedVec returns job_gpu_allocated, which compared to
+// job_gpu_count shows jobs that don't use the GPUs they requested.
+func newJobGPUAllocatedVec() *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "job_gpu_allocated",
+		Help: "Number of GPUs per node the Slurm job requested, from its TresPerNode or Gres in scontrol.",
+	}, []string{"job_id"})
+}
+
+// jobGPUsPerNode returns the number of GPUs per node requested by the job,
+// from TresPerNode, or Gres on older Slurm versions. ok is false if the job
+// requested no GPU.
+func jobGPUsPerNode(metadata jobMetadata) (float64, bool) {
+	for _, field := range []string{"TresPerNode", "Gres"} {
+		if count, ok := parseGPUGres(metadata[field]); ok {
+			return count, true
+		}
+	}
+	return 0, false
+}
+
+// parseGPUGres returns the number of GPUs in a comma-separated GRES list
+// such as "gres:gpu:2", "gres/gpu:a100:2", "gres/gpu=2" or "gpu:a100:2(IDX:0-1)".
+// A GPU without a count is one GPU.
+func parseGPUGres(spec string) (float64, bool) {
+	var total float64
+	found := false
+	for _, gres := range strings.Split(spec, ",") {
+		gres, _, _ = strings.Cut(gres, "(")
+		gres = strings.TrimPrefix(strings.TrimPrefix(gres, "gres:"), "gres/")
+		parts := strings.FieldsFunc(gres, func(r rune) bool { return r == ':' || r == '=' })
+		if len(parts) == 0 || parts[0] != "gpu" {
+			continue
+		}
+		count := 1.0
+		if len(parts) > 1 {
+			// The count is last, after the optional GPU type.
+			if n, err := strconv.ParseFloat(parts[len(parts)-1], 64); err == nil {
+				count = n
+			}
+		}
+		total += count
+		found = true
+	}
+	return total, found
+}
+
+// fetchJobMetadata runs scontrol for a single job and parses its one-line
+// key=value output.
+func fetchJobMetadata(ctx context.Context, jobID string) (jobMetadata, error) {
+	output, err := exec.CommandContext(ctx, "scontrol", "show", "job", jobID, "-o").Output()
+	if err != nil {
+		return nil, fmt.Errorf("scontrol show job %s failed: %v", jobID, err)
+	}
+	return parseJobMetadata(string(output)), nil
+}
+
+func parseJobMetadata(output string) jobMetadata {
+	metadata := make(jobMetadata)
+	last := ""
+	for _, token := range strings.Fields(output) {
+		if key, value, ok := strings.Cut(token, "="); ok {
+			metadata[key] = value
+			last = key
+			continue
+		}
+		// Values such as JobName are printed as is, spaces included.
+		if last != "" {
+			metadata[last] += " " + token
+		}
+	}
+	return metadata
+}
+
+type jobMetadataEntry struct {
+	metadata jobMetadata
+	expires  time.Time
+}
+
+// jobMetadataCache fetches each job's metadata at most once per TTL, so that
+// enrichment doesn't overload slurmctld with scontrol calls on busy nodes.
+// Failed fetches are not cached and are retried on the next lookup.
+type jobMetadataCache struct {
+	ttl   time.Duration
+	fetch func(ctx context.Context, jobID string) (jobMetadata, error)
+	clock clock
+
+	mu      sync.Mutex
+	entries map[string]jobMetadataEntry
+}
+
+func newJobMetadataCache(ttl time.Duration) *jobMetadataCache {
+	return &jobMetadataCache{
+		ttl:     ttl,
+		fetch:   fetchJobMetadata,
+		clock:   realClock{},
+		entries: make(map[string]jobMetadataEntry),
+	}
+}
+
+// get returns the metadata of jobID, fetching it if it isn't cached or the
+// cached entry expired.
+func (c *jobMetadataCache) get(ctx context.Context, jobID string) (jobMetadata, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[jobID]
+	c.mu.Unlock()
+	if ok && c.clock.Now().Before(entry.expires) {
+		return entry.metadata, nil
+	}
+
+	metadata, err := c.fetch(ctx, jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.entries[jobID] = jobMetadataEntry{metadata: metadata, expires: c.clock.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return metadata, nil
+}
+
+// evict drops the entries of jobs that are no longer present and returns
+// their IDs.
+func (c *jobMetadataCache) evict(jobIDs map[string]struct{}) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var evicted []string
+	for jobID := range c.entries {
+		if _, exists := jobIDs[jobID]; !exists {
+			delete(c.entries, jobID)
+			evicted = append(evicted, jobID)
+		}
+	}
+	return evicted
+}
+
+// collectJobInfo exposes job_info and job_gpu_allocated for every running job
+// from the cached scontrol metadata, and removes the series of jobs that
+// ended.
+func collectJobInfo(ctx context.Context, cache *jobMetadataCache, jobInfo *jobInfoVec, gpuAllocated *prometheus.GaugeVec, jobIDs map[string]struct{}) error {
+	for _, jobID := range cache.evict(jobIDs) {
+		jobInfo.DeletePartialMatch(prometheus.Labels{"job_id": jobID})
+		gpuAllocated.DeleteLabelValues(jobID)
+	}
+
+	for jobID := range jobIDs {
+		metadata, err := cache.get(ctx, jobID)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			fmt.Printf("WARN: Failed to fetch metadata for job %s: %v\n", jobID, err)
+			continue
+		}
+
+		labels := prometheus.Labels{"job_id": jobID}
+		for _, l := range jobInfo.labels {
+			labels[l.label] = metadata[l.field]
+		}
+		// UserId is reported as name(uid); keep just the name.
+		if user, _, ok := strings.Cut(labels["user"], "("); ok {
+			labels["user"] = user
+		}
+		if name, ok := labels["job_name"]; ok {
+			labels["job_name"] = sanitizeJobName(name)
+		}
+		// The metadata can change while the job runs, e.g. scontrol update
+		// moving it to another partition, so the series of its previous
+		// metadata goes.
+		jobInfo.DeletePartialMatch(prometheus.Labels{"job_id": jobID})
+		jobInfo.With(labels).Set(1)
+
+		if count, ok := jobGPUsPerNode(metadata); ok {
+			gpuAllocated.WithLabelValues(jobID).Set(count)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestJobMetadataCache(t *testing.T) {
+	clk := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	cache := newJobMetadataCache(5 * time.Minute)
+	cache.clock = clk
+	fetches := 0
+	var fetchErr error
+	cache.fetch = func(ctx context.Context, jobID string) (jobMetadata, error) {
+		fetches++
+		if fetchErr != nil {
+			return nil, fetchErr
+		}
+		return jobMetadata{"JobId": jobID}, nil
+	}
+	get := func(wantFetches int) {
+		t.Helper()
+		metadata, err := cache.get(context.Background(), "42")
+		if fetchErr != nil && err == nil {
+			t.Fatalf("get(42) = %v, want the fetch error", metadata)
+		}
+		if fetchErr == nil && (err != nil || metadata["JobId"] != "42") {
+			t.Fatalf("get(42) = %v, %v", metadata, err)
+		}
+		if fetches != wantFetches {
+			t.Fatalf("%d fetches, want %d", fetches, wantFetches)
+		}
+	}
+
+	get(1)
+	// Hit.
+	clk.advance(4 * time.Minute)
+	get(1)
+	// Expiry.
+	clk.advance(time.Minute)
+	get(2)
+
+	// Eviction of the jobs that ended.
+	if evicted := cache.evict(map[string]struct{}{"43": {}}); len(evicted) != 1 || evicted[0] != "42" {
+		t.Errorf("evict() = %v, want [42]", evicted)
+	}
+	if evicted := cache.evict(map[string]struct{}{"42": {}}); len(evicted) != 0 {
+		t.Errorf("evict() of an empty cache = %v, want none", evicted)
+	}
+	get(3)
+
+	// Failed fetches aren't cached.
+	cache.evict(nil)
+	fetchErr = errors.New("slurmctld unreachable")
+	get(4)
+	get(5)
+	fetchErr = nil
+	get(6)
+	get(6)
+}
+
+func TestCollectJobInfoReplacesChangedMetadata(t *testing.T) {
+	clk := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	cache := newJobMetadataCache(time.Minute)
+	cache.clock = clk
+	partition := "gpu"
+	cache.fetch = func(ctx context.Context, jobID string) (jobMetadata, error) {
+		return jobMetadata{"UserId": "alice(1000)", "Account": "physics", "Partition": partition, "JobName": "train"}, nil
+	}
+	jobInfo := newJobInfoVec(nil, nil)
+	gpuAllocated := newJobGPUAllocatedVec()
+	jobIDs := map[string]struct{}{"42": {}}
+
+	if err := collectJobInfo(context.Background(), cache, jobInfo, gpuAllocated, jobIDs); err != nil {
+		t.Fatal(err)
+	}
+	// The job moved partition, which shows once its metadata expires.
+	partition = "gpu-long"
+	clk.advance(time.Minute)
+	if err := collectJobInfo(context.Background(), cache, jobInfo, gpuAllocated, jobIDs); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `
+# HELP job_info Always 1, labeled with the Slurm job's metadata from scontrol.
+# TYPE job_info gauge
+job_info{account="physics",job_id="42",job_name="train",partition="gpu-long",user="alice"} 1
+`
+	if err := testutil.CollectAndCompare(jobInfo, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
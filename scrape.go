@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// scrapeCoalesceWindow is how long the metrics of a scrape-time collection
+// are served to later scrapes, e.g. from redundant Prometheus servers,
+// before collecting again.
+const scrapeCoalesceWindow = time.Second
+
+// scrapeGatherer runs a collection cycle before gathering, for
+// -scrape-mode=scrape. Concurrent scrapes wait for the cycle in progress
+// and share its result.
+type scrapeGatherer struct {
+	prometheus.Gatherer
+	ctx     context.Context
+	collect func(context.Context)
+	clock   clock
+
+	mu        sync.Mutex
+	collected time.Time
+}
+
+// Gather implements prometheus.Gatherer.
+func (g *scrapeGatherer) Gather() ([]*dto.MetricFamily, error) {
+	g.mu.Lock()
+	if now := g.clock.Now(); now.Sub(g.collected) >= scrapeCoalesceWindow {
+		g.collect(g.ctx)
+		// The window starts once the cycle is done, so that a slow cycle
+		// isn't followed by another one right away.
+		g.collected = g.clock.Now()
+	}
+	g.mu.Unlock()
+	return g.Gatherer.Gather()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scratchJobIDPlaceholder is replaced by the job ID in -scratch.path.
+const scratchJobIDPlaceholder = "{job_id}"
+
+// scratchCollector exposes the disk space used by the scratch directory of
+// each job, e.g. /scratch/<job ID>, to catch jobs filling local scratch. The
+// usage is summed like du does, from the blocks allocated to every file,
+// counting hard links once. The walk stops maxDepth levels below the
+// directory and after timeout, so the usage of a deep or huge tree is a lower
+// bound.
+type scratchCollector struct {
+	bytes    *limitedGaugeVec
+	path     string
+	maxDepth int
+	timeout  time.Duration
+
+	jobs map[string]struct{}
+}
+
+// newScratchCollector creates the scratch usage metric, limited to maxSeries
+// series like the other job-level metrics, and registers it with reg.
+func newScratchCollector(reg prometheus.Registerer, cfg ScratchConfig, maxSeries int, droppedSeries *prometheus.CounterVec) *scratchCollector {
+	c := &scratchCollector{
+		bytes: newLimitedGaugeVec(prometheus.GaugeOpts{
+			Name: "job_scratch_bytes",
+			Help: "Disk space used by the job's scratch directory in bytes, a lower bound if the walk hit -scratch.max-depth or -scratch.timeout.",
+		}, []string{"job_id"}, maxSeries, droppedSeries),
+		path:     cfg.Path,
+		maxDepth: cfg.MaxDepth,
+		timeout:  cfg.Timeout,
+		jobs:     make(map[string]struct{}),
+	}
+	register(reg, c.bytes)
+	return c
+}
+
+// collect sets the scratch usage of every job with a scratch directory, and
+// removes the series of the others.
+func (c *scratchCollector) collect(ctx context.Context, jobs []slurmJob) error {
+	current := make(map[string]struct{})
+	for _, job := range jobs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Job IDs come from directory names, which must not lead the walk
+		// elsewhere.
+		if job.ID == "." || job.ID == ".." || strings.Contains(job.ID, "/") {
+			continue
+		}
+		dir := strings.ReplaceAll(c.path, scratchJobIDPlaceholder, job.ID)
+		usage, err := c.walk(ctx, dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Jobs without scratch.
+			continue
+		}
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			debugf("Walking the scratch directory %s of job %s timed out, exposing the usage found so far", dir, job.ID)
+		} else if err != nil {
+			return err
+		}
+		c.bytes.Set(prometheus.Labels{"job_id": job.ID}, usage)
+		current[job.ID] = struct{}{}
+	}
+
+	for jobID := range c.jobs {
+		if _, exists := current[jobID]; !exists {
+			c.bytes.Delete(prometheus.Labels{"job_id": jobID})
+		}
+	}
+	c.jobs = current
+	return nil
+}
+
+// walk returns the disk space used by dir, down to maxDepth levels below it.
+func (c *scratchCollector) walk(ctx context.Context, dir string) (float64, error) {
+	if _, err := os.Lstat(dir); err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var usage float64
+	type inode struct{ dev, ino uint64 }
+	linked := make(map[inode]struct{})
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Files the job removed or keeps private are left out.
+			if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() && path != dir && strings.Count(strings.TrimPrefix(path, dir), string(filepath.Separator)) > c.maxDepth {
+			return filepath.SkipDir
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		if stat.Nlink > 1 && !entry.IsDir() {
+			key := inode{dev: uint64(stat.Dev), ino: stat.Ino}
+			if _, seen := linked[key]; seen {
+				return nil
+			}
+			linked[key] = struct{}{}
+		}
+		// st_blocks counts 512-byte blocks whatever the filesystem's block
+		// size.
+		usage += float64(stat.Blocks) * 512
+		return nil
+	})
+	return usage, err
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// slurmJobMaxDepth is how many directory levels under a root of
+// -cgroup.slurm-paths are searched for job directories.
+const slurmJobMaxDepth = 4
+
+// defaultSlurmJobPatterns match the job directories of the cgroup layouts of
+// the Slurm releases in use, by their path relative to a root:
+//
+//   - uid_<uid>/job_<id>, the cgroup v1 plugin's, also found as
+//     slurm/uid_<uid>/job_<id> under a hybrid or v2 mount.
+//   - slurmstepd.scope/job_<id>, the cgroup v2 plugin's since Slurm 22.05,
+//     named <nodename>_slurmstepd.scope with several slurmd per node, and
+//     slurmstepd-<n>.scope by some packagings.
+var defaultSlurmJobPatterns = stringList{
+	`(^|/)uid_(?P<uid>[0-9]+)/job_(?P<job>[^/]+)$`,
+	`(^|/)([^/]+_)?slurmstepd(-[0-9]+)?\.scope/job_(?P<job>[^/]+)$`,
+}
+
+// compileSlurmJobPatterns compiles -cgroup.slurm-job-patterns. Every pattern
+// must capture the job ID in a group named job, and may capture the UID of
+// its owner in one named uid.
+func compileSlurmJobPatterns(patterns stringList) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cgroup.slurm-job-patterns entry %q: %v", pattern, err)
+		}
+		if re.SubexpIndex("job") < 0 {
+			return nil, fmt.Errorf("cgroup.slurm-job-patterns entry %q has no (?P<job>...) group", pattern)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// slurmJobDir is a job directory found under a Slurm cgroup root.
+type slurmJobDir struct {
+	path  string
+	rawID string // as named by the directory, before -label.job-id-*
+	uid   string // empty if the pattern doesn't capture it
+}
+
+// findSlurmJobDirs lists the directories under basePath, up to
+// slurmJobMaxDepth levels deep, whose path relative to it matches one of
+// patterns. Matching directories aren't searched further, as their
+// subdirectories are the job's steps and tasks.
+func findSlurmJobDirs(ctx context.Context, patterns []*regexp.Regexp, basePath string) ([]slurmJobDir, error) {
+	entries, err := os.ReadDir(basePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the base directory: %w", err)
+	}
+
+	var dirs []slurmJobDir
+	var search func(rel string, entries []os.DirEntry, depth int) error
+	search = func(rel string, entries []os.DirEntry, depth int) error {
+		for _, entry := range entries {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !entry.IsDir() {
+				continue
+			}
+			path := filepath.Join(rel, entry.Name())
+			if dir, ok := matchSlurmJobDir(patterns, path); ok {
+				dir.path = filepath.Join(basePath, path)
+				dirs = append(dirs, dir)
+				continue
+			}
+			if depth == slurmJobMaxDepth {
+				continue
+			}
+			// Cgroups come and go, so unreadable ones are skipped.
+			children, err := os.ReadDir(filepath.Join(basePath, path))
+			if err != nil {
+				continue
+			}
+			if err := search(path, children, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := search("", entries, 1); err != nil {
+		return nil, err
+	}
+	return dirs, nil
+}
+
+// matchSlurmJobDir matches rel, the path of a directory relative to a Slurm
+// cgroup root, against patterns, the first match winning.
+func matchSlurmJobDir(patterns []*regexp.Regexp, rel string) (slurmJobDir, bool) {
+	for _, pattern := range patterns {
+		match := pattern.FindStringSubmatch(rel)
+		if match == nil {
+			continue
+		}
+		dir := slurmJobDir{rawID: match[pattern.SubexpIndex("job")]}
+		if i := pattern.SubexpIndex("uid"); i >= 0 {
+			dir.uid = match[i]
+		}
+		return dir, true
+	}
+	return slurmJobDir{}, false
+}
+
+// readCgroupTree returns the PIDs in the cgroup.procs of dir and of its
+// descendants, and the number of their threads. On cgroup v2 the processes
+// of a job are in the cgroups of its steps, never in the job's own.
+func readCgroupTree(dir string) (pids []string, threads int, err error) {
+	// The job's own cgroup.procs tells a cgroup directory from another.
+	if _, err := os.Stat(filepath.Join(dir, "cgroup.procs")); err != nil {
+		return nil, 0, err
+	}
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Steps that ended since the walk started.
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		content, err := os.ReadFile(filepath.Join(path, "cgroup.procs"))
+		if err != nil {
+			return nil
+		}
+		pids = append(pids, strings.Fields(string(content))...)
+		threads += countCgroupThreads(path)
+		return nil
+	})
+	return pids, threads, err
+}
+
+// cgroupTreeContains reports whether pid is listed in one of the files named
+// names, such as cgroup.procs, of dir or of its descendants.
+func cgroupTreeContains(dir string, names []string, pid string) (bool, error) {
+	found := false
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() {
+			return nil
+		}
+		for _, name := range names {
+			ok, err := cgroupFileContains(filepath.Join(path, name), pid)
+			if err != nil {
+				return err
+			}
+			if ok {
+				found = true
+				return filepath.SkipAll
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// processUID returns the UID owning the process pid, for the jobs whose
+// cgroup path doesn't name their owner, or "" if it has exited.
+func processUID(pid string) string {
+	info, err := os.Stat(hostPath("/proc/" + pid))
+	if err != nil {
+		return ""
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	return strconv.FormatUint(uint64(stat.Uid), 10)
+}
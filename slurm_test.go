@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+// slurmReleaseLayouts are the job directories of job 42 of UID 1000 in the
+// cgroup layouts of the Slurm releases in use, relative to a root of
+// -cgroup.slurm-paths, with the UID the path names.
+var slurmReleaseLayouts = []struct {
+	name string
+	rel  string
+	uid  string
+}{
+	{"cgroup v1", "uid_1000/job_42", "1000"},
+	{"cgroup v1 under a hybrid mount", "slurm/uid_1000/job_42", "1000"},
+	{"cgroup v2, 22.05 and later", "slurmstepd.scope/job_42", ""},
+	{"cgroup v2 with several slurmd", "node1_slurmstepd.scope/job_42", ""},
+	{"cgroup v2, numbered scope", "system.slice/slurmstepd-1.scope/job_42", ""},
+}
+
+func TestMatchSlurmJobDir(t *testing.T) {
+	cfg := newTestConfig(t)
+	for _, tc := range slurmReleaseLayouts {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, ok := matchSlurmJobDir(cfg.Cgroup.slurmJobPatterns, tc.rel)
+			if !ok || dir.rawID != "42" || dir.uid != tc.uid {
+				t.Errorf("matchSlurmJobDir(%q) = %+v, %v, want job 42 of UID %q", tc.rel, dir, ok, tc.uid)
+			}
+		})
+	}
+
+	for _, rel := range []string{
+		"uid_1000",
+		"slurmstepd.scope",
+		"slurmstepd.scope/system",
+		"user.slice/user-1000.slice/session-1.scope",
+		"uid_1000/job_42/step_0",
+		"slurmstepd.scope/job_42/step_batch",
+	} {
+		if dir, ok := matchSlurmJobDir(cfg.Cgroup.slurmJobPatterns, rel); ok {
+			t.Errorf("matchSlurmJobDir(%q) = %+v, want no job directory", rel, dir)
+		}
+	}
+}
+
+func TestFindSlurmJobDirs(t *testing.T) {
+	cfg := newTestConfig(t)
+	for _, tc := range slurmReleaseLayouts {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			writeTestFile(t, filepath.Join(root, tc.rel, "step_0", "cgroup.procs"), "100\n")
+			writeTestFile(t, filepath.Join(root, tc.rel, "step_0", "task_0", "cgroup.procs"), "101\n")
+
+			dirs, err := findSlurmJobDirs(context.Background(), cfg.Cgroup.slurmJobPatterns, root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Steps and tasks aren't searched, so they aren't jobs.
+			if len(dirs) != 1 || dirs[0].path != filepath.Join(root, tc.rel) || dirs[0].rawID != "42" {
+				t.Errorf("findSlurmJobDirs() = %+v, want job 42 in %s", dirs, tc.rel)
+			}
+		})
+	}
+}
+
+func TestFindJobPID(t *testing.T) {
+	for _, tc := range slurmReleaseLayouts {
+		t.Run(tc.name, func(t *testing.T) {
+			// On cgroup v2 the processes are in the cgroups of the steps.
+			newTestRootfs(t, map[string]string{
+				slurmCgroupPath + "/" + tc.rel + "/cgroup.procs":        "",
+				slurmCgroupPath + "/" + tc.rel + "/step_0/cgroup.procs": "100\n",
+			})
+			if got := findJobPID(newTestConfig(t)); got != "100" {
+				t.Errorf("findJobPID() = %q, want \"100\"", got)
+			}
+		})
+	}
+
+	newTestRootfs(t, nil)
+	if got := findJobPID(newTestConfig(t)); got != "" {
+		t.Errorf("findJobPID() without jobs = %q, want none", got)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// snapshotGatherer serves the metric families gathered at the end of the last
+// collection cycle, with the interval -scrape-mode. Scrapes read the snapshot
+// without waiting for a cycle in progress nor seeing it half applied, and a
+// slow scrape, e.g. over a congested network, never delays the collectors.
+// The exporter's runtime metrics are as of the snapshot too.
+type snapshotGatherer struct {
+	gatherer prometheus.Gatherer
+
+	// mu orders the updates, so that the cycles of concurrent loops can't
+	// replace a snapshot with an older one.
+	mu   sync.Mutex
+	last atomic.Pointer[metricsSnapshot]
+}
+
+type metricsSnapshot struct {
+	families []*dto.MetricFamily
+	err      error
+}
+
+// newSnapshotGatherer returns a snapshotGatherer of g, with a first snapshot
+// of its metrics as they are now.
+func newSnapshotGatherer(g prometheus.Gatherer) *snapshotGatherer {
+	s := &snapshotGatherer{gatherer: g}
+	s.update()
+	return s
+}
+
+// update replaces the snapshot with what the gatherer gathers now. It is
+// called at the end of every cycle.
+func (s *snapshotGatherer) update() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	families, err := s.gatherer.Gather()
+	s.last.Store(&metricsSnapshot{families: families, err: err})
+}
+
+// Gather implements prometheus.Gatherer. The snapshot is shared by
+// concurrent scrapes, so each gets a copy it may modify, e.g. to set units.
+func (s *snapshotGatherer) Gather() ([]*dto.MetricFamily, error) {
+	snapshot := s.last.Load()
+	families := make([]*dto.MetricFamily, len(snapshot.families))
+	for i, family := range snapshot.families {
+		families[i] = proto.Clone(family).(*dto.MetricFamily)
+	}
+	return families, snapshot.err
+}
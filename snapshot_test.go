@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestSnapshotGathererConcurrentScrapes is meant to be run with -race.
+func TestSnapshotGathererConcurrentScrapes(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	read := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_read", Help: "Test gauge."})
+	written := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_written", Help: "Test gauge."})
+	reg.MustRegister(read, written)
+	s := newSnapshotGatherer(reg)
+
+	const cycles = 200
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= cycles; i++ {
+			// A cycle sets both, then takes the snapshot.
+			read.Set(float64(i))
+			written.Set(float64(i))
+			s.update()
+		}
+	}()
+	for scraper := 0; scraper < 4; scraper++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			last := 0.0
+			for i := 0; i < cycles; i++ {
+				families, err := s.Gather()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(families) != 2 {
+					t.Errorf("Gather() returned %d families, want 2", len(families))
+					return
+				}
+				readValue := families[0].GetMetric()[0].GetGauge().GetValue()
+				writtenValue := families[1].GetMetric()[0].GetGauge().GetValue()
+				if readValue != writtenValue {
+					t.Errorf("Gather() returned a cycle half applied: test_read %v, test_written %v", readValue, writtenValue)
+				}
+				if readValue < last {
+					t.Errorf("Gather() went back from cycle %v to %v", last, readValue)
+				}
+				last = readValue
+				// Scrapes may modify their copy, e.g. to set units.
+				unit := "bytes"
+				families[0].Unit = &unit
+				families[0].GetMetric()[0].GetGauge().Value = nil
+			}
+		}()
+	}
+	wg.Wait()
+
+	families, err := s.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := families[0].GetMetric()[0].GetGauge().GetValue(); got != cycles {
+		t.Errorf("test_read = %v after the last cycle, want %d", got, cycles)
+	}
+	if families[0].Unit != nil {
+		t.Errorf("a scrape's change of its copy reached the snapshot")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gpuThrottleField is the nvidia-smi field with the bitmask of the reasons
+// the GPU's clocks are currently held down, from NVML's
+// nvmlClocksThrottleReasons.
+const gpuThrottleField = "clocks_throttle_reasons.active"
+
+// gpuThrottleReasons maps the bits of gpuThrottleField to the reason label of
+// gpu_throttle_seconds_total.
+var gpuThrottleReasons = []struct {
+	bit    uint64
+	reason string
+}{
+	{0x1, "gpu_idle"},
+	{0x2, "applications_clocks_setting"},
+	{0x4, "sw_power_cap"},
+	{0x8, "hw_slowdown"},
+	{0x10, "sync_boost"},
+	{0x20, "sw_thermal_slowdown"},
+	{0x40, "hw_thermal_slowdown"},
+	{0x80, "hw_power_brake_slowdown"},
+	{0x100, "display_clock_setting"},
+}
+
+// gpuThrottle accumulates the time each throttle reason of each GPU was
+// active. The reasons are only sampled once per cycle, so a reason active at
+// a cycle is counted for the whole time until the next one: a flickering
+// reason averages out over many cycles, which rate() turns into the fraction
+// of time the GPU was throttled.
+type gpuThrottle struct {
+	seconds *prometheus.CounterVec
+
+	last     map[string]uint64 // active reasons by GPU index
+	lastTime time.Time
+	interval time.Duration // of the GPU loop
+}
+
+// newGPUThrottle creates the throttle counter and registers it with reg.
+// interval is the GPU collection interval.
+func newGPUThrottle(reg prometheus.Registerer, interval time.Duration) *gpuThrottle {
+	t := &gpuThrottle{
+		seconds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gpu_throttle_seconds_total",
+			Help: "Seconds the GPU's clocks were held down for the reason, sampled once per collection cycle from clocks_throttle_reasons.active.",
+		}, []string{"gpu_id", "reason"}),
+		last:     make(map[string]uint64),
+		interval: interval,
+	}
+	register(reg, t.seconds)
+	return t
+}
+
+// update adds the time since the previous cycle to the reasons that were
+// active then, and records the reasons of gpus at now. GPUs whose reasons
+// can't be read, e.g. [N/A], aren't counted until the next cycle that reads
+// them, rather than carrying stale reasons over the gap.
+func (t *gpuThrottle) update(gpus []gpuInfo, now time.Time) {
+	elapsed := elapsedSeconds(t.lastTime, now, t.interval)
+	current := make(map[string]uint64)
+	for _, gpu := range gpus {
+		index := gpu["index"]
+		active, err := strconv.ParseUint(strings.TrimPrefix(gpu[gpuThrottleField], "0x"), 16, 64)
+		if err != nil {
+			continue
+		}
+		current[index] = active
+
+		last, seen := t.last[index]
+		for _, r := range gpuThrottleReasons {
+			// Exposed from 0, so that the first throttled cycle is an
+			// increase.
+			counter := t.seconds.WithLabelValues(index, r.reason)
+			if seen && elapsed > 0 && last&r.bit != 0 {
+				counter.Add(elapsed)
+			}
+		}
+	}
+
+	t.last = current
+	t.lastTime = now
+}
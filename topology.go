@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gpuTopology holds the site-specific labels of each GPU from
+// -gpu.topology-file, e.g. its physical slot and rack, to match the GPU
+// metrics with an inventory or DCIM system. The file is a CSV file whose
+// header names the GPU column, index or uuid, followed by the labels:
+//
+//	uuid,slot,rack
+//	GPU-5fb0...,3,r12
+//
+// The labels are added to the device-level GPU metrics, those with a gpu_id
+// label but no job_id, when they are gathered.
+type gpuTopology struct {
+	labelNames []string
+	byIndex    bool
+	values     map[string][]string // by index or UUID, in labelNames order
+
+	mu      sync.Mutex
+	uuids   map[string]string // by index, from the last device query
+	missing map[string]struct{}
+}
+
+// readGPUTopology reads a -gpu.topology-file. reserved are the label names
+// it can't use, as the exporter's metrics already have them.
+func readGPUTopology(path string, reserved stringList) (*gpuTopology, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+
+	header := records[0]
+	t := &gpuTopology{
+		values:  make(map[string][]string),
+		uuids:   make(map[string]string),
+		missing: make(map[string]struct{}),
+	}
+	switch strings.TrimSpace(header[0]) {
+	case "index":
+		t.byIndex = true
+	case "uuid":
+	default:
+		return nil, fmt.Errorf("%s: unknown GPU column %q, expected index or uuid", path, header[0])
+	}
+	for _, name := range header[1:] {
+		name = strings.TrimSpace(name)
+		if !labelNamePattern.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("%s: invalid label name %q", path, name)
+		}
+		if reserved.contains(name) || stringList(t.labelNames).contains(name) {
+			return nil, fmt.Errorf("%s: label %q is already a label of the exporter's metrics", path, name)
+		}
+		t.labelNames = append(t.labelNames, name)
+	}
+	for _, record := range records[1:] {
+		values := make([]string, len(record)-1)
+		for i, value := range record[1:] {
+			values[i] = strings.TrimSpace(value)
+		}
+		t.values[strings.TrimSpace(record[0])] = values
+	}
+	return t, nil
+}
+
+// setGPUs records the UUID of each GPU of a device query, by index.
+func (t *gpuTopology) setGPUs(gpus []gpuInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, gpu := range gpus {
+		t.uuids[gpu["index"]] = gpu["gpu_uuid"]
+	}
+}
+
+// lookup returns the label values of the GPU of the given index, or nil if
+// the file has no entry for it.
+func (t *gpuTopology) lookup(index string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := t.uuids[index]
+	if t.byIndex {
+		key = index
+	}
+	if values, ok := t.values[key]; ok {
+		return values
+	}
+	// GPUs reported as N/A, e.g. for jobs without one, have no UUID.
+	if _, known := t.uuids[index]; known {
+		if _, logged := t.missing[index]; !logged {
+			debugf("GPU %s (%s) has no entry in gpu.topology-file, exposing it without topology labels", index, t.uuids[index])
+			t.missing[index] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// wrap returns a gatherer that adds the topology labels to what g gathers,
+// or g itself without a topology.
+func (t *gpuTopology) wrap(g prometheus.Gatherer) prometheus.Gatherer {
+	if t == nil {
+		return g
+	}
+	return &topologyGatherer{Gatherer: g, topology: t}
+}
+
+// topologyGatherer adds the labels of a gpuTopology to the device-level GPU
+// metrics of the gatherer it wraps.
+type topologyGatherer struct {
+	prometheus.Gatherer
+	topology *gpuTopology
+}
+
+// Gather implements prometheus.Gatherer.
+func (g *topologyGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			index, device := "", true
+			for _, pair := range metric.Label {
+				switch pair.GetName() {
+				case "gpu_id":
+					index = pair.GetValue()
+				case "job_id":
+					device = false
+				}
+			}
+			if index == "" || !device {
+				continue
+			}
+			values := g.topology.lookup(index)
+			if values == nil {
+				continue
+			}
+			for i, name := range g.topology.labelNames {
+				metric.Label = append(metric.Label, &dto.LabelPair{Name: &name, Value: &values[i]})
+			}
+			// The exposition formats expect the labels sorted by name.
+			sort.Slice(metric.Label, func(i, j int) bool {
+				return metric.Label[i].GetName() < metric.Label[j].GetName()
+			})
+		}
+	}
+	return families, err
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+const landingPage = `<html>
+<head><title>Job Metrics Exporter</title></head>
+<body>
+<h1>Job Metrics Exporter</h1>
+<p><a href="%s">Metrics</a></p>
+</body>
+</html>
+`
+
+// landingHandler serves a small HTML page at "/" linking to the telemetry
+// path, as is conventional for Prometheus exporters.
+func landingHandler(telemetryPath string) http.Handler {
+	page := fmt.Sprintf(landingPage, html.EscapeString(telemetryPath))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, page)
+	})
+}
+
+// metricUnits are the units metric names end with, before the _total suffix
+// of counters.
+var metricUnits = []string{"bytes", "mebibytes", "seconds", "percent", "celsius", "watts", "hertz", "ratio"}
+
+// unitGatherer sets the OpenMetrics unit of the metric families whose name
+// ends with one of metricUnits.
+type unitGatherer struct {
+	prometheus.Gatherer
+}
+
+// Gather implements prometheus.Gatherer.
+func (g unitGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+	for _, family := range families {
+		name := family.GetName()
+		if family.GetType() == dto.MetricType_COUNTER {
+			name = strings.TrimSuffix(name, "_total")
+		}
+		for _, unit := range metricUnits {
+			if strings.HasSuffix(name, "_"+unit) {
+				family.Unit = proto.String(unit)
+				break
+			}
+		}
+	}
+	return families, err
+}
+
+// metricsHandler serves the metrics of gatherer. The format is negotiated
+// from the Accept header: the text format, protobuf, or OpenMetrics, which
+// e.g. exemplars require. promhttp doesn't write the # UNIT metadata of
+// OpenMetrics, so that format is encoded here.
+func metricsHandler(gatherer prometheus.Gatherer) http.Handler {
+	gatherer = unitGatherer{gatherer}
+	promHandler := promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := expfmt.NegotiateIncludingOpenMetrics(r.Header)
+		if format.FormatType() != expfmt.TypeOpenMetrics {
+			promHandler.ServeHTTP(w, r)
+			return
+		}
+
+		families, err := gatherer.Gather()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to gather metrics: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", string(format))
+		var out io.Writer = w
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			out = gz
+		}
+		encoder := expfmt.NewEncoder(out, format, expfmt.WithUnit())
+		for _, family := range families {
+			if err := encoder.Encode(family); err != nil {
+				fmt.Printf("WARN: Failed to encode metric family %s: %v\n", family.GetName(), err)
+				return
+			}
+		}
+		if closer, ok := encoder.(expfmt.Closer); ok {
+			closer.Close()
+		}
+	})
+}
+
+// serverTLSConfig returns the TLS configuration of the metrics server, nil
+// without -web.tls-cert-file. With -web.tls-client-ca-file, clients must
+// present a certificate signed by one of its CAs.
+func serverTLSConfig(cfg WebConfig) (*tls.Config, error) {
+	if cfg.TLSCertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the TLS certificate: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.TLSClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the client CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificate found in %s", cfg.TLSClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
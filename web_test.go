@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestMetricsHandlerContentNegotiation(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	memory := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gpu_memory_usage_bytes",
+		Help: "GPU memory.",
+	}, []string{"gpu_id", "job_id"})
+	memory.WithLabelValues("0", "42").Set(1024)
+	collectionErrors := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "job_exporter_collection_errors_total",
+		Help: "Errors.",
+	})
+	collectionErrors.Add(3)
+	registry.MustRegister(memory, collectionErrors)
+	server := httptest.NewServer(metricsHandler(registry))
+	defer server.Close()
+
+	get := func(t *testing.T, accept string) (*http.Response, []byte) {
+		t.Helper()
+		request, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accept != "" {
+			request.Header.Set("Accept", accept)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("status %d: %s", response.StatusCode, body)
+		}
+		return response, body
+	}
+
+	// decode parses body in the negotiated format, which the text and
+	// protobuf decoders of expfmt read.
+	decode := func(t *testing.T, response *http.Response, body []byte) map[string]*dto.MetricFamily {
+		t.Helper()
+		decoder := expfmt.NewDecoder(strings.NewReader(string(body)), expfmt.ResponseFormat(response.Header))
+		families := make(map[string]*dto.MetricFamily)
+		for {
+			family := &dto.MetricFamily{}
+			if err := decoder.Decode(family); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("failed to parse the response: %v", err)
+			}
+			families[family.GetName()] = family
+		}
+		return families
+	}
+
+	for _, tc := range []struct {
+		name     string
+		accept   string
+		wantType expfmt.FormatType
+	}{
+		{"no Accept header", "", expfmt.TypeTextPlain},
+		{"text", "text/plain;version=0.0.4", expfmt.TypeTextPlain},
+		{"protobuf", "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited", expfmt.TypeProtoDelim},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			response, body := get(t, tc.accept)
+			if got := expfmt.ResponseFormat(response.Header).FormatType(); got != tc.wantType {
+				t.Fatalf("Content-Type %q, want format %v", response.Header.Get("Content-Type"), tc.wantType)
+			}
+			families := decode(t, response, body)
+			family := families["gpu_memory_usage_bytes"]
+			if family == nil || len(family.Metric) != 1 || family.Metric[0].GetGauge().GetValue() != 1024 {
+				t.Errorf("gpu_memory_usage_bytes = %v, want one series of 1024", family)
+			}
+			if family := families["job_exporter_collection_errors_total"]; len(family.GetMetric()) != 1 || family.Metric[0].GetCounter().GetValue() != 3 {
+				t.Errorf("job_exporter_collection_errors_total = %v, want 3", family)
+			}
+		})
+	}
+
+	t.Run("OpenMetrics", func(t *testing.T) {
+		response, body := get(t, "application/openmetrics-text;version=1.0.0")
+		contentType := response.Header.Get("Content-Type")
+		if !strings.HasPrefix(contentType, "application/openmetrics-text") {
+			t.Fatalf("Content-Type %q, want application/openmetrics-text", contentType)
+		}
+		// expfmt has no OpenMetrics parser, so check the parts the
+		// format adds to the text format.
+		text := string(body)
+		for _, want := range []string{
+			"# TYPE gpu_memory_usage_bytes gauge\n",
+			"# UNIT gpu_memory_usage_bytes bytes\n",
+			`gpu_memory_usage_bytes{gpu_id="0",job_id="42"} 1024.0` + "\n",
+			"# TYPE job_exporter_collection_errors counter\n",
+			"job_exporter_collection_errors_total 3.0\n",
+		} {
+			if !strings.Contains(text, want) {
+				t.Errorf("response lacks %q:\n%s", want, text)
+			}
+		}
+		if !strings.HasSuffix(text, "# EOF\n") {
+			t.Errorf("response doesn't end with # EOF:\n%s", text)
+		}
+	})
+}